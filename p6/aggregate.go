@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AggregateFunction describes an aggregate callable in the SELECT list,
+// HAVING and ORDER BY of a select.
+type AggregateFunction struct {
+	min_args int
+	max_args int
+}
+
+var AGGREGATES = map[string]AggregateFunction{
+	"avg":   {1, 1},
+	"count": {0, 1},
+	"max":   {1, 1},
+	"min":   {1, 1},
+	"sum":   {1, 1},
+}
+
+// AggregateState accumulates one aggregate over the rows of one group.
+type AggregateState struct {
+	count       int64 // rows for count(*), non-NULL values otherwise
+	sum_integer int64
+	sum_real    float64
+	real        bool  // sum is kept in sum_real, after a real value or an overflow
+	overflow    bool  // the integer sum went past 64 bits
+	value       Value // min or max so far
+}
+
+// Group is the state of one GROUP BY group. row holds the values bare
+// columns in the SELECT list refer to: those of the row the first min() or
+// max() of the select took its value from, as in SQLite, otherwise those of
+// the first row of the group.
+type Group struct {
+	keys   []Value
+	row    []Value
+	states []AggregateState
+}
+
+// Grouping collects the rows of an aggregate select into groups as they are
+// scanned.
+type Grouping struct {
+	statement *Statement
+	groups    map[string]*Group
+	order     []*Group
+}
+
+// collect_aggregates turns the aggregate calls in expr into EXPR_AGGREGATE
+// nodes and adds them to statement.aggregates. The value of aggregate i is
+// read from column len(columns) + i of a group's output row.
+func collect_aggregates(expr *Expr, statement *Statement, columns []string) *SyntaxError {
+	if expr == nil {
+		return nil
+	}
+	if expr.et == EXPR_FUNCTION {
+		if function, ok := AGGREGATES[expr.text]; ok {
+			if len(expr.args) < function.min_args || len(expr.args) > function.max_args {
+				return &SyntaxError{expr.pos, fmt.Sprintf("wrong number of arguments to function %s()", expr.text)}
+			}
+			for _, arg := range expr.args {
+				// Aggregates cannot be nested, resolve_expr reports a misuse.
+				if err := resolve_expr(arg, columns); err != nil {
+					return err
+				}
+			}
+			expr.et = EXPR_AGGREGATE
+			expr.column = len(columns) + len(statement.aggregates)
+			statement.aggregates = append(statement.aggregates, expr)
+			return nil
+		}
+	}
+	if err := collect_aggregates(expr.left, statement, columns); err != nil {
+		return err
+	}
+	if err := collect_aggregates(expr.right, statement, columns); err != nil {
+		return err
+	}
+	for _, arg := range expr.args {
+		if err := collect_aggregates(arg, statement, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contains_aggregate(expr *Expr) bool {
+	if expr == nil {
+		return false
+	}
+	if expr.et == EXPR_AGGREGATE {
+		return true
+	}
+	if contains_aggregate(expr.left) || contains_aggregate(expr.right) {
+		return true
+	}
+	for _, arg := range expr.args {
+		if contains_aggregate(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregate_step adds a row to an aggregate and reports whether the row
+// gave a min() or max() its new value.
+func aggregate_step(state *AggregateState, aggregate *Expr, row []Value) bool {
+	if len(aggregate.args) == 0 {
+		// count(*)
+		state.count += 1
+		return false
+	}
+	value := eval_expr(aggregate.args[0], row)
+	if value.vt == VALUE_NULL {
+		return false
+	}
+	state.count += 1
+	switch aggregate.text {
+	case "sum", "avg":
+		if value.vt == VALUE_REAL {
+			if !state.real {
+				state.real = true
+				state.sum_real = float64(state.sum_integer)
+			}
+			// The sum is approximate now, SQLite gives no overflow error
+			// for it.
+			state.overflow = false
+			state.sum_real += value_to_real(value)
+		} else if state.real {
+			state.sum_real += value_to_real(value)
+		} else if sum, ok := add_integers(state.sum_integer, value_to_integer(value)); ok {
+			state.sum_integer = sum
+		} else {
+			// avg goes on with a real sum, sum() reports the overflow.
+			state.overflow = true
+			state.real = true
+			state.sum_real = float64(state.sum_integer) + float64(value_to_integer(value))
+		}
+	case "min":
+		if state.count == 1 || compare_values(value, state.value) < 0 {
+			state.value = value
+			return true
+		}
+	case "max":
+		if state.count == 1 || compare_values(value, state.value) > 0 {
+			state.value = value
+			return true
+		}
+	}
+	return false
+}
+
+// min_max_aggregate returns the index of the first min() or max() of a
+// select, -1 if it has none.
+func min_max_aggregate(st *Statement) int {
+	for i, aggregate := range st.aggregates {
+		if (aggregate.text == "min" || aggregate.text == "max") && len(aggregate.args) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// aggregate_result gives NULL for sum, avg, min and max over no values, and
+// avg is always real.
+func aggregate_result(state *AggregateState, aggregate *Expr) Value {
+	if aggregate.text == "count" {
+		return integer_value(state.count)
+	}
+	if state.count == 0 {
+		return null_value()
+	}
+	switch aggregate.text {
+	case "sum":
+		if state.overflow {
+			eval_fail("integer overflow")
+		}
+		if state.real {
+			return real_value(state.sum_real)
+		}
+		return integer_value(state.sum_integer)
+	case "avg":
+		sum := float64(state.sum_integer)
+		if state.real {
+			sum = state.sum_real
+		}
+		return real_value(sum / float64(state.count))
+	}
+	return state.value
+}
+
+// group_key encodes the GROUP BY values so that equal values give equal
+// keys.
+func group_key(keys []Value) string {
+	var key strings.Builder
+	for _, value := range keys {
+		if value.vt == VALUE_REAL && value.real == math.Trunc(value.real) && value.real >= math.MinInt64 && value.real < -math.MinInt64 {
+			// 1 and 1.0 are the same group. Integers are not made real,
+			// which would put distinct ones past 2^53 together.
+			value = integer_value(int64(value.real))
+		}
+		switch value.vt {
+		case VALUE_INTEGER:
+			fmt.Fprintf(&key, "i%d:", value.integer)
+		case VALUE_REAL:
+			fmt.Fprintf(&key, "r%s:", strconv.FormatFloat(value.real, 'g', -1, 64))
+		default:
+			text := value_to_text(value)
+			fmt.Fprintf(&key, "%d%d:%s", value.vt, len(text), text)
+		}
+	}
+	return key.String()
+}
+
+func grouping_add(grouping *Grouping, row []Value) {
+	st := grouping.statement
+	keys := make([]Value, len(st.group_by))
+	for i, expr := range st.group_by {
+		keys[i] = eval_expr(expr, row)
+	}
+	key := group_key(keys)
+	group, ok := grouping.groups[key]
+	if !ok {
+		group = &Group{keys: keys, row: row, states: make([]AggregateState, len(st.aggregates))}
+		grouping.groups[key] = group
+		grouping.order = append(grouping.order, group)
+	}
+	minMax := min_max_aggregate(st)
+	for i, aggregate := range st.aggregates {
+		if aggregate_step(&group.states[i], aggregate, row) && i == minMax {
+			group.row = row
+		}
+	}
+}
+
+// grouping_rows returns a row per group that passes HAVING, ordered by the
+// GROUP BY values. Each row is the group's row, see Group, followed by the
+// result of every aggregate. Without GROUP BY there is always exactly one
+// group, even when no row matched.
+func grouping_rows(grouping *Grouping, numColumns int) [][]Value {
+	st := grouping.statement
+	if len(grouping.order) == 0 && len(st.group_by) == 0 {
+		row := make([]Value, numColumns)
+		for i := range row {
+			row[i] = null_value()
+		}
+		grouping.order = append(grouping.order, &Group{row: row, states: make([]AggregateState, len(st.aggregates))})
+	}
+
+	ascending := make([]OrderTerm, len(st.group_by))
+	sort.SliceStable(grouping.order, func(i, j int) bool {
+		return compare_sort_keys(ascending, grouping.order[i].keys, grouping.order[j].keys) < 0
+	})
+
+	var rows [][]Value
+	for _, group := range grouping.order {
+		row := append(group.row[:numColumns:numColumns], make([]Value, len(st.aggregates))...)
+		for i, aggregate := range st.aggregates {
+			row[numColumns+i] = aggregate_result(&group.states[i], aggregate)
+		}
+		if row_matches(st.having, row) {
+			rows = append(rows, row)
+		}
+	}
+	log.Printf("INFO: grouping_rows: %d groups, %d after HAVING\n", len(grouping.order), len(rows))
+	return rows
+}
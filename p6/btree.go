@@ -0,0 +1,921 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+type NodeType uint8
+
+const (
+	NODE_INTERNAL NodeType = iota
+	NODE_LEAF
+	NODE_FREE
+	NODE_OVERFLOW
+)
+
+/*
+ * Common Node Header Layout
+ */
+const (
+	NODE_TYPE_SIZE          = 1
+	NODE_TYPE_OFFSET        = 0
+	IS_ROOT_SIZE            = 1
+	IS_ROOT_OFFSET          = NODE_TYPE_SIZE
+	PARENT_POINTER_SIZE     = 4
+	PARENT_POINTER_OFFSET   = IS_ROOT_OFFSET + IS_ROOT_SIZE
+	COMMON_NODE_HEADER_SIZE = NODE_TYPE_SIZE + IS_ROOT_SIZE + PARENT_POINTER_SIZE
+)
+
+/*
+ * Leaf Node Header Layout. content_start is the offset of the cell closest
+ * to the header, cells are packed from there to the end of the page.
+ */
+const (
+	LEAF_NODE_NUM_CELLS_SIZE       = 4
+	LEAF_NODE_NUM_CELLS_OFFSET     = COMMON_NODE_HEADER_SIZE
+	LEAF_NODE_NEXT_LEAF_SIZE       = 4
+	LEAF_NODE_NEXT_LEAF_OFFSET     = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
+	LEAF_NODE_CONTENT_START_SIZE   = 4
+	LEAF_NODE_CONTENT_START_OFFSET = LEAF_NODE_NEXT_LEAF_OFFSET + LEAF_NODE_NEXT_LEAF_SIZE
+	LEAF_NODE_HEADER_SIZE          = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE + LEAF_NODE_CONTENT_START_SIZE
+)
+
+/*
+ * Internal Node Header Layout
+ */
+const (
+	INTERNAL_NODE_NUM_KEYS_SIZE      = 4
+	INTERNAL_NODE_NUM_KEYS_OFFSET    = COMMON_NODE_HEADER_SIZE
+	INTERNAL_NODE_RIGHT_CHILD_SIZE   = 4
+	INTERNAL_NODE_RIGHT_CHILD_OFFSET = INTERNAL_NODE_NUM_KEYS_OFFSET + INTERNAL_NODE_NUM_KEYS_SIZE
+	INTERNAL_NODE_HEADER_SIZE        = COMMON_NODE_HEADER_SIZE + INTERNAL_NODE_NUM_KEYS_SIZE + INTERNAL_NODE_RIGHT_CHILD_SIZE
+)
+
+/*
+ * Internal Node Body Layout. How many keys fit depends on the page size of
+ * the file.
+ */
+const (
+	INTERNAL_NODE_CHILD_SIZE = 4
+	INTERNAL_NODE_KEY_SIZE   = 8
+	INTERNAL_NODE_CELL_SIZE  = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
+)
+
+func internal_node_max_keys(pageSize uint32) uint32 {
+	return (pageSize - INTERNAL_NODE_HEADER_SIZE) / INTERNAL_NODE_CELL_SIZE
+}
+
+/*
+ * Leaf Node Body Layout. The header is followed by the offsets of the
+ * cells in key order. A cell is the key, the payload size as a varint, the
+ * part of the payload kept in the leaf and, if the rest is in overflow
+ * pages, the first overflow page.
+ */
+const (
+	LEAF_NODE_CELL_POINTER_SIZE     = 2
+	LEAF_NODE_KEY_SIZE              = 8
+	LEAF_NODE_KEY_OFFSET            = 0
+	LEAF_NODE_PAYLOAD_SIZE_OFFSET   = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
+	LEAF_NODE_OVERFLOW_POINTER_SIZE = 4
+)
+
+func leaf_node_space_for_cells(pageSize uint32) uint32 {
+	return pageSize - LEAF_NODE_HEADER_SIZE
+}
+
+// leaf_node_max_cell_size is the most a cell and its pointer take, a
+// quarter of the space, so the cells of a full leaf and one more always
+// fit in two leaves.
+func leaf_node_max_cell_size(pageSize uint32) uint32 {
+	return leaf_node_space_for_cells(pageSize) / 4
+}
+
+/*
+ * Overflow Page Layout. Overflow pages hold the part of a payload that
+ * does not fit in its cell, chained by the page number of the next one.
+ */
+const (
+	OVERFLOW_NEXT_PAGE_SIZE   = 4
+	OVERFLOW_NEXT_PAGE_OFFSET = NODE_TYPE_SIZE
+	OVERFLOW_PAGE_HEADER_SIZE = NODE_TYPE_SIZE + OVERFLOW_NEXT_PAGE_SIZE
+)
+
+func overflow_page_space(pageSize uint32) uint32 {
+	return pageSize - OVERFLOW_PAGE_HEADER_SIZE
+}
+
+func uvarint_size(n uint32) uint32 {
+	var buffer [binary.MaxVarintLen64]byte
+	return uint32(binary.PutUvarint(buffer[:], uint64(n)))
+}
+
+// leaf_node_local_size returns how many bytes of a payload are kept in the
+// cell. A payload that would make the cell larger than
+// leaf_node_max_cell_size keeps what fits and the rest goes to overflow
+// pages.
+func leaf_node_local_size(pageSize uint32, payloadSize uint32) uint32 {
+	overhead := LEAF_NODE_CELL_POINTER_SIZE + LEAF_NODE_KEY_SIZE + uvarint_size(payloadSize)
+	maxCellSize := leaf_node_max_cell_size(pageSize)
+	if overhead+payloadSize <= maxCellSize {
+		return payloadSize
+	}
+	return maxCellSize - overhead - LEAF_NODE_OVERFLOW_POINTER_SIZE
+}
+
+// leaf_node_cell_size is the size of the cell for a payload, without its
+// cell pointer.
+func leaf_node_cell_size(pageSize uint32, payloadSize uint32) uint32 {
+	local := leaf_node_local_size(pageSize, payloadSize)
+	size := LEAF_NODE_KEY_SIZE + uvarint_size(payloadSize) + local
+	if local < payloadSize {
+		size += LEAF_NODE_OVERFLOW_POINTER_SIZE
+	}
+	return size
+}
+
+func get_node_type(node []byte) NodeType {
+	return NodeType(node[NODE_TYPE_OFFSET])
+}
+
+func set_node_type(node []byte, nodeType NodeType) {
+	node[NODE_TYPE_OFFSET] = byte(nodeType)
+}
+
+func is_node_root(node []byte) bool {
+	return node[IS_ROOT_OFFSET] == 1
+}
+
+func set_node_root(node []byte, isRoot bool) {
+	if isRoot {
+		node[IS_ROOT_OFFSET] = 1
+	} else {
+		node[IS_ROOT_OFFSET] = 0
+	}
+}
+
+func node_parent(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[PARENT_POINTER_OFFSET:])
+}
+
+func set_node_parent(node []byte, parent uint32) {
+	binary.LittleEndian.PutUint32(node[PARENT_POINTER_OFFSET:], parent)
+}
+
+func leaf_node_num_cells(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NUM_CELLS_OFFSET:])
+}
+
+func set_leaf_node_num_cells(node []byte, numCells uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NUM_CELLS_OFFSET:], numCells)
+}
+
+// leaf_node_next_leaf returns the page number of the right sibling, 0
+// means this is the rightmost leaf (page 0 holds the file header so it is
+// never a sibling).
+func leaf_node_next_leaf(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:])
+}
+
+func set_leaf_node_next_leaf(node []byte, nextLeaf uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:], nextLeaf)
+}
+
+func leaf_node_content_start(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_CONTENT_START_OFFSET:])
+}
+
+func set_leaf_node_content_start(node []byte, offset uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_CONTENT_START_OFFSET:], offset)
+}
+
+func leaf_node_cell_offset(node []byte, cellNum uint32) uint32 {
+	return uint32(binary.LittleEndian.Uint16(node[LEAF_NODE_HEADER_SIZE+cellNum*LEAF_NODE_CELL_POINTER_SIZE:]))
+}
+
+func set_leaf_node_cell_offset(node []byte, cellNum uint32, offset uint32) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_HEADER_SIZE+cellNum*LEAF_NODE_CELL_POINTER_SIZE:], uint16(offset))
+}
+
+func leaf_node_cell(node []byte, cellNum uint32) []byte {
+	cell := node[leaf_node_cell_offset(node, cellNum):]
+	payloadSize, _ := binary.Uvarint(cell[LEAF_NODE_PAYLOAD_SIZE_OFFSET:])
+	return cell[:leaf_node_cell_size(uint32(len(node)), uint32(payloadSize))]
+}
+
+// leaf_node_cells returns copies of all cells of a leaf.
+func leaf_node_cells(node []byte) [][]byte {
+	cells := make([][]byte, leaf_node_num_cells(node))
+	for i := range cells {
+		cells[i] = bytes.Clone(leaf_node_cell(node, uint32(i)))
+	}
+	return cells
+}
+
+// Keys are signed 64 bit integers, rowids or INTEGER PRIMARY KEY values.
+func leaf_node_key(node []byte, cellNum uint32) int64 {
+	return int64(binary.LittleEndian.Uint64(leaf_node_cell(node, cellNum)[LEAF_NODE_KEY_OFFSET:]))
+}
+
+func leaf_node_free_space(node []byte) uint32 {
+	return leaf_node_content_start(node) - LEAF_NODE_HEADER_SIZE - leaf_node_num_cells(node)*LEAF_NODE_CELL_POINTER_SIZE
+}
+
+// leaf_node_insert_cell puts a cell at position cellNum. The caller checks
+// that it fits.
+func leaf_node_insert_cell(node []byte, cellNum uint32, cell []byte) {
+	numCells := leaf_node_num_cells(node)
+	start := leaf_node_content_start(node) - uint32(len(cell))
+	copy(node[start:], cell)
+	pointers := node[LEAF_NODE_HEADER_SIZE:]
+	copy(pointers[(cellNum+1)*LEAF_NODE_CELL_POINTER_SIZE:], pointers[cellNum*LEAF_NODE_CELL_POINTER_SIZE:numCells*LEAF_NODE_CELL_POINTER_SIZE])
+	set_leaf_node_num_cells(node, numCells+1)
+	set_leaf_node_cell_offset(node, cellNum, start)
+	set_leaf_node_content_start(node, start)
+}
+
+// write_leaf_cells replaces the cells of a leaf, packed at the end of the
+// page.
+func write_leaf_cells(node []byte, cells [][]byte) {
+	set_leaf_node_num_cells(node, 0)
+	set_leaf_node_content_start(node, uint32(len(node)))
+	for i, cell := range cells {
+		leaf_node_insert_cell(node, uint32(i), cell)
+	}
+}
+
+// create_leaf_cell builds the cell for key and payload, writing the part of
+// the payload that does not fit to overflow pages.
+func create_leaf_cell(pager *Pager, key int64, payload []byte) []byte {
+	payloadSize := uint32(len(payload))
+	local := leaf_node_local_size(pager.page_size, payloadSize)
+	cell := binary.LittleEndian.AppendUint64(nil, uint64(key))
+	cell = binary.AppendUvarint(cell, uint64(payloadSize))
+	cell = append(cell, payload[:local]...)
+	if local < payloadSize {
+		cell = binary.LittleEndian.AppendUint32(cell, write_overflow_pages(pager, payload[local:]))
+	}
+	return cell
+}
+
+// write_overflow_pages stores data in a chain of overflow pages and returns
+// the first one. The last page has next page 0.
+func write_overflow_pages(pager *Pager, data []byte) uint32 {
+	var firstPageNum uint32
+	var previous []byte
+	for len(data) > 0 {
+		pageNum := get_unused_page_num(pager)
+		page := get_page_for_write(pager, pageNum).data
+		clear(page)
+		set_node_type(page, NODE_OVERFLOW)
+		data = data[copy(page[OVERFLOW_PAGE_HEADER_SIZE:], data):]
+		if previous == nil {
+			firstPageNum = pageNum
+		} else {
+			binary.LittleEndian.PutUint32(previous[OVERFLOW_NEXT_PAGE_OFFSET:], pageNum)
+		}
+		previous = page
+	}
+	return firstPageNum
+}
+
+// cell_payload returns the whole payload of a leaf cell, reading the
+// overflow pages if it has any.
+func cell_payload(pager *Pager, cell []byte) []byte {
+	payloadSize, n := binary.Uvarint(cell[LEAF_NODE_PAYLOAD_SIZE_OFFSET:])
+	local := uint64(leaf_node_local_size(pager.page_size, uint32(payloadSize)))
+	start := LEAF_NODE_PAYLOAD_SIZE_OFFSET + uint64(n)
+	payload := make([]byte, 0, payloadSize)
+	payload = append(payload, cell[start:start+local]...)
+	if local < payloadSize {
+		pageNum := binary.LittleEndian.Uint32(cell[start+local:])
+		for uint64(len(payload)) < payloadSize {
+			page := get_page(pager, pageNum).data
+			size := min(payloadSize-uint64(len(payload)), uint64(overflow_page_space(pager.page_size)))
+			payload = append(payload, page[OVERFLOW_PAGE_HEADER_SIZE:OVERFLOW_PAGE_HEADER_SIZE+size]...)
+			pageNum = binary.LittleEndian.Uint32(page[OVERFLOW_NEXT_PAGE_OFFSET:])
+		}
+	}
+	return payload
+}
+
+// free_cell_overflow frees the overflow pages of a leaf cell.
+func free_cell_overflow(pager *Pager, cell []byte) {
+	payloadSize, n := binary.Uvarint(cell[LEAF_NODE_PAYLOAD_SIZE_OFFSET:])
+	local := leaf_node_local_size(pager.page_size, uint32(payloadSize))
+	if uint64(local) == payloadSize {
+		return
+	}
+	pageNum := binary.LittleEndian.Uint32(cell[LEAF_NODE_PAYLOAD_SIZE_OFFSET+uint32(n)+local:])
+	for pageNum != 0 {
+		next := binary.LittleEndian.Uint32(get_page(pager, pageNum).data[OVERFLOW_NEXT_PAGE_OFFSET:])
+		free_page(pager, pageNum)
+		pageNum = next
+	}
+}
+
+func internal_node_num_keys(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:])
+}
+
+func set_internal_node_num_keys(node []byte, numKeys uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:], numKeys)
+}
+
+func internal_node_right_child(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:])
+}
+
+func set_internal_node_right_child(node []byte, child uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:], child)
+}
+
+func internal_node_cell(node []byte, cellNum uint32) []byte {
+	offset := INTERNAL_NODE_HEADER_SIZE + cellNum*INTERNAL_NODE_CELL_SIZE
+	return node[offset : offset+INTERNAL_NODE_CELL_SIZE]
+}
+
+// internal_node_child returns the page number of child childNum, where
+// childNum == num_keys addresses the right child.
+func internal_node_child(node []byte, childNum uint32) uint32 {
+	numKeys := internal_node_num_keys(node)
+	if childNum > numKeys {
+		log.Fatalf("ERROR: internal_node_child: Tried to access child %d > num_keys %d\n", childNum, numKeys)
+	}
+	if childNum == numKeys {
+		return internal_node_right_child(node)
+	}
+	return binary.LittleEndian.Uint32(internal_node_cell(node, childNum))
+}
+
+func set_internal_node_child(node []byte, childNum uint32, child uint32) {
+	if childNum == internal_node_num_keys(node) {
+		set_internal_node_right_child(node, child)
+		return
+	}
+	binary.LittleEndian.PutUint32(internal_node_cell(node, childNum), child)
+}
+
+// internal_node_key returns the separator for child keyNum: every key in
+// that child's subtree is <= the separator, every key to its right is greater.
+func internal_node_key(node []byte, keyNum uint32) int64 {
+	return int64(binary.LittleEndian.Uint64(internal_node_cell(node, keyNum)[INTERNAL_NODE_CHILD_SIZE:]))
+}
+
+func set_internal_node_key(node []byte, keyNum uint32, key int64) {
+	binary.LittleEndian.PutUint64(internal_node_cell(node, keyNum)[INTERNAL_NODE_CHILD_SIZE:], uint64(key))
+}
+
+func initialize_leaf_node(node []byte) {
+	set_node_type(node, NODE_LEAF)
+	set_node_root(node, false)
+	set_leaf_node_num_cells(node, 0)
+	set_leaf_node_next_leaf(node, 0)
+	set_leaf_node_content_start(node, uint32(len(node)))
+}
+
+func initialize_internal_node(node []byte) {
+	set_node_type(node, NODE_INTERNAL)
+	set_node_root(node, false)
+	set_internal_node_num_keys(node, 0)
+	set_internal_node_right_child(node, 0)
+}
+
+// free_tree frees a node and everything below it, overflow pages included.
+func free_tree(pager *Pager, pageNum uint32) {
+	node := get_page(pager, pageNum).data
+	if get_node_type(node) == NODE_INTERNAL {
+		for i := uint32(0); i <= internal_node_num_keys(node); i++ {
+			free_tree(pager, internal_node_child(node, i))
+		}
+	} else {
+		for i := uint32(0); i < leaf_node_num_cells(node); i++ {
+			free_cell_overflow(pager, leaf_node_cell(node, i))
+		}
+	}
+	free_page(pager, pageNum)
+}
+
+// build_tree copies the rows from source to the end of its table into a new
+// B-tree in pager and returns the root page. Inserting them one at a time
+// would leave every leaf half full, so each leaf and internal node is
+// filled before the next one is started.
+func build_tree(pager *Pager, source *Cursor) uint32 {
+	var children []uint32
+	var keys []int64 // the largest key under each child
+	leafPageNum := get_unused_page_num(pager)
+	initialize_leaf_node(get_page_for_write(pager, leafPageNum).data)
+	for ; !source.end_of_table; cursor_advance(source) {
+		pager_release(source.table.pager)
+		pager_release(pager)
+		cell := create_leaf_cell(pager, cursor_key(source), cursor_payload(source))
+		leaf := get_page_for_write(pager, leafPageNum).data
+		if leaf_node_free_space(leaf) < uint32(len(cell))+LEAF_NODE_CELL_POINTER_SIZE {
+			children = append(children, leafPageNum)
+			keys = append(keys, leaf_node_key(leaf, leaf_node_num_cells(leaf)-1))
+			leafPageNum = get_unused_page_num(pager)
+			set_leaf_node_next_leaf(leaf, leafPageNum)
+			leaf = get_page_for_write(pager, leafPageNum).data
+			initialize_leaf_node(leaf)
+		}
+		leaf_node_insert_cell(leaf, leaf_node_num_cells(leaf), cell)
+	}
+	leaf := get_page(pager, leafPageNum).data
+	children = append(children, leafPageNum)
+	if numCells := leaf_node_num_cells(leaf); numCells > 0 {
+		keys = append(keys, leaf_node_key(leaf, numCells-1))
+	} else {
+		keys = append(keys, 0)
+	}
+
+	// Build each level of internal nodes from the one below, spreading the
+	// children evenly, until a single node is left.
+	maxChildren := int(internal_node_max_keys(pager.page_size)) + 1
+	for len(children) > 1 {
+		numNodes := (len(children) + maxChildren - 1) / maxChildren
+		perNode := (len(children) + numNodes - 1) / numNodes
+		var parents []uint32
+		var parentKeys []int64
+		for start := 0; start < len(children); start += perNode {
+			pager_release(pager)
+			end := min(start+perNode, len(children))
+			pageNum := get_unused_page_num(pager)
+			node := get_page_for_write(pager, pageNum).data
+			initialize_internal_node(node)
+			write_internal_node(node, children[start:end], keys[start:end-1])
+			for _, child := range children[start:end] {
+				set_node_parent(get_page_for_write(pager, child).data, pageNum)
+			}
+			parents = append(parents, pageNum)
+			parentKeys = append(parentKeys, keys[end-1])
+		}
+		children, keys = parents, parentKeys
+	}
+	set_node_root(get_page_for_write(pager, children[0]).data, true)
+	return children[0]
+}
+
+func table_start(table *Table) *Cursor {
+	return table_seek(table, math.MinInt64)
+}
+
+// table_seek returns a cursor on the first row with a key >= key, or a
+// cursor with end_of_table set if there is no such row.
+func table_seek(table *Table, key int64) *Cursor {
+	cursor := table_find(table, key)
+	node := get_page(table.pager, cursor.page_num).data
+	if cursor.cell_num >= leaf_node_num_cells(node) {
+		// key is past the end of this leaf, the next row is the first
+		// cell of the right sibling.
+		nextPageNum := leaf_node_next_leaf(node)
+		if nextPageNum == 0 {
+			cursor.end_of_table = true
+		} else {
+			cursor.page_num = nextPageNum
+			cursor.cell_num = 0
+		}
+	}
+	return cursor
+}
+
+// table_seek_reverse returns a cursor on the last row with a key <= key,
+// for walking backwards from key with cursor_prev.
+func table_seek_reverse(table *Table, key int64) *Cursor {
+	if key == math.MaxInt64 {
+		return table_last(table)
+	}
+	cursor := table_seek(table, key+1)
+	if cursor.end_of_table {
+		return table_last(table)
+	}
+	cursor_prev(cursor)
+	return cursor
+}
+
+// table_last returns a cursor on the row with the largest key, for walking
+// the table from end to start with cursor_prev.
+func table_last(table *Table) *Cursor {
+	pageNum := rightmost_leaf(table.pager, table.root_page_num)
+	numCells := leaf_node_num_cells(get_page(table.pager, pageNum).data)
+	if numCells == 0 {
+		return &Cursor{
+			table:        table,
+			page_num:     pageNum,
+			end_of_table: true,
+		}
+	}
+	return &Cursor{
+		table:    table,
+		page_num: pageNum,
+		cell_num: numCells - 1,
+	}
+}
+
+func rightmost_leaf(pager *Pager, pageNum uint32) uint32 {
+	node := get_page(pager, pageNum).data
+	for get_node_type(node) == NODE_INTERNAL {
+		pageNum = internal_node_right_child(node)
+		node = get_page(pager, pageNum).data
+	}
+	return pageNum
+}
+
+// table_find returns a cursor at the position of key, or at the position
+// where key would have to be inserted if it is not present.
+func table_find(table *Table, key int64) *Cursor {
+	pageNum := table.root_page_num
+	node := get_page(table.pager, pageNum).data
+	for get_node_type(node) == NODE_INTERNAL {
+		childIndex := internal_node_find_child(node, key)
+		pageNum = internal_node_child(node, childIndex)
+		node = get_page(table.pager, pageNum).data
+	}
+	return leaf_node_find(table, pageNum, key)
+}
+
+func leaf_node_find(table *Table, pageNum uint32, key int64) *Cursor {
+	node := get_page(table.pager, pageNum).data
+	numCells := leaf_node_num_cells(node)
+	cellNum := uint32(sort.Search(int(numCells), func(i int) bool {
+		return leaf_node_key(node, uint32(i)) >= key
+	}))
+	return &Cursor{
+		table:    table,
+		page_num: pageNum,
+		cell_num: cellNum,
+	}
+}
+
+// internal_node_find_child returns the index of the child which should
+// contain key.
+func internal_node_find_child(node []byte, key int64) uint32 {
+	numKeys := internal_node_num_keys(node)
+	return uint32(sort.Search(int(numKeys), func(i int) bool {
+		return internal_node_key(node, uint32(i)) >= key
+	}))
+}
+
+func cursor_key(cursor *Cursor) int64 {
+	page := get_page(cursor.table.pager, cursor.page_num)
+	return leaf_node_key(page.data, cursor.cell_num)
+}
+
+func cursor_payload(cursor *Cursor) []byte {
+	page := get_page(cursor.table.pager, cursor.page_num)
+	return cell_payload(cursor.table.pager, leaf_node_cell(page.data, cursor.cell_num))
+}
+
+func cursor_advance(cursor *Cursor) {
+	node := get_page(cursor.table.pager, cursor.page_num).data
+	cursor.cell_num += 1
+	if cursor.cell_num >= leaf_node_num_cells(node) {
+		nextPageNum := leaf_node_next_leaf(node)
+		if nextPageNum == 0 {
+			cursor.end_of_table = true
+		} else {
+			cursor.page_num = nextPageNum
+			cursor.cell_num = 0
+		}
+	}
+}
+
+// cursor_prev moves the cursor one row towards the start of the table and
+// sets end_of_table once it has moved before the first row.
+func cursor_prev(cursor *Cursor) {
+	if cursor.cell_num > 0 {
+		cursor.cell_num -= 1
+		return
+	}
+	prevPageNum, ok := prev_leaf(cursor.table.pager, cursor.page_num)
+	if !ok {
+		cursor.end_of_table = true
+		return
+	}
+	cursor.page_num = prevPageNum
+	cursor.cell_num = leaf_node_num_cells(get_page(cursor.table.pager, prevPageNum).data) - 1
+}
+
+// prev_leaf finds the left sibling of a leaf. Leaves only link to the right,
+// so walk up the parent pointers until there is a subtree to the left and
+// take its rightmost leaf.
+func prev_leaf(pager *Pager, pageNum uint32) (uint32, bool) {
+	node := get_page(pager, pageNum).data
+	for !is_node_root(node) {
+		parentPageNum := node_parent(node)
+		parent := get_page(pager, parentPageNum).data
+		childIndex := internal_node_child_index(parent, pageNum)
+		if childIndex > 0 {
+			return rightmost_leaf(pager, internal_node_child(parent, childIndex-1)), true
+		}
+		pageNum = parentPageNum
+		node = parent
+	}
+	return 0, false
+}
+
+// internal_node_child_index returns the position of childPageNum among the
+// children of node.
+func internal_node_child_index(node []byte, childPageNum uint32) uint32 {
+	numKeys := internal_node_num_keys(node)
+	for i := uint32(0); i <= numKeys; i++ {
+		if internal_node_child(node, i) == childPageNum {
+			return i
+		}
+	}
+	log.Fatalf("ERROR: internal_node_child_index: Page %d is not a child of this node\n", childPageNum)
+	return 0
+}
+
+func leaf_node_insert(cursor *Cursor, key int64, payload []byte) {
+	node := get_page_for_write(cursor.table.pager, cursor.page_num).data
+	cell := create_leaf_cell(cursor.table.pager, key, payload)
+	if leaf_node_free_space(node) < uint32(len(cell))+LEAF_NODE_CELL_POINTER_SIZE {
+		leaf_node_split_and_insert(cursor, cell)
+		return
+	}
+	leaf_node_insert_cell(node, cursor.cell_num, cell)
+}
+
+// leaf_node_split_and_insert creates a new right sibling and spreads the
+// cells (including the new one) over both leaves by size, then registers
+// the sibling with the parent.
+func leaf_node_split_and_insert(cursor *Cursor, cell []byte) {
+	pager := cursor.table.pager
+	oldPageNum := cursor.page_num
+	oldNode := get_page_for_write(pager, oldPageNum).data
+	newPageNum := get_unused_page_num(pager)
+	newNode := get_page_for_write(pager, newPageNum).data
+	initialize_leaf_node(newNode)
+	set_node_parent(newNode, node_parent(oldNode))
+	set_leaf_node_next_leaf(newNode, leaf_node_next_leaf(oldNode))
+	set_leaf_node_next_leaf(oldNode, newPageNum)
+
+	cells := leaf_node_cells(oldNode)
+	cells = append(cells[:cursor.cell_num], append([][]byte{cell}, cells[cursor.cell_num:]...)...)
+	total := 0
+	for _, c := range cells {
+		total += len(c) + LEAF_NODE_CELL_POINTER_SIZE
+	}
+	leftSplitCount, leftSize := 0, 0
+	for leftSplitCount < len(cells)-1 && (leftSplitCount == 0 || leftSize < total/2) {
+		leftSize += len(cells[leftSplitCount]) + LEAF_NODE_CELL_POINTER_SIZE
+		leftSplitCount++
+	}
+	write_leaf_cells(oldNode, cells[:leftSplitCount])
+	write_leaf_cells(newNode, cells[leftSplitCount:])
+	log.Printf("INFO: leaf_node_split_and_insert: Split page %d into %d and %d\n", oldPageNum, oldPageNum, newPageNum)
+
+	separator := leaf_node_key(oldNode, uint32(leftSplitCount)-1)
+	if is_node_root(oldNode) {
+		create_new_root(cursor.table, separator, newPageNum)
+	} else {
+		internal_node_insert(cursor.table, node_parent(oldNode), oldPageNum, separator, newPageNum)
+	}
+}
+
+// leaf_node_delete removes the cell under the cursor and compacts the leaf.
+// A non-root leaf that becomes empty is unlinked from the tree and its page
+// goes back to the pager for reuse.
+func leaf_node_delete(cursor *Cursor) {
+	pager := cursor.table.pager
+	node := get_page_for_write(pager, cursor.page_num).data
+	numCells := leaf_node_num_cells(node)
+	cells := leaf_node_cells(node)
+	free_cell_overflow(pager, cells[cursor.cell_num])
+	write_leaf_cells(node, append(cells[:cursor.cell_num], cells[cursor.cell_num+1:]...))
+
+	if is_node_root(node) {
+		return
+	}
+	if numCells-1 > 0 {
+		if leaf_node_free_space(node) > leaf_node_space_for_cells(pager.page_size)*3/4 {
+			leaf_node_merge(cursor.table, cursor.page_num)
+		}
+		return
+	}
+
+	if prevPageNum, ok := prev_leaf(pager, cursor.page_num); ok {
+		prevNode := get_page_for_write(pager, prevPageNum).data
+		set_leaf_node_next_leaf(prevNode, leaf_node_next_leaf(node))
+	}
+	internal_node_remove_child(cursor.table, node_parent(node), cursor.page_num)
+	free_page(pager, cursor.page_num)
+	log.Printf("INFO: leaf_node_delete: Freed empty leaf page %d\n", cursor.page_num)
+}
+
+// leaf_node_merge moves the cells of a leaf that is less than a quarter full
+// and those of a sibling under the same parent into the right one of the
+// two, if they fit, and frees the left one.
+func leaf_node_merge(table *Table, pageNum uint32) {
+	pager := table.pager
+	parentPageNum := node_parent(get_page(pager, pageNum).data)
+	parent := get_page(pager, parentPageNum).data
+	numKeys := internal_node_num_keys(parent)
+	if numKeys == 0 {
+		return
+	}
+	leftPageNum, rightPageNum := pageNum, uint32(0)
+	if childIndex := internal_node_child_index(parent, pageNum); childIndex < numKeys {
+		rightPageNum = internal_node_child(parent, childIndex+1)
+	} else {
+		leftPageNum, rightPageNum = internal_node_child(parent, childIndex-1), pageNum
+	}
+	left := get_page(pager, leftPageNum).data
+	right := get_page(pager, rightPageNum).data
+	space := leaf_node_space_for_cells(pager.page_size)
+	if 2*space-leaf_node_free_space(left)-leaf_node_free_space(right) > space {
+		return
+	}
+
+	if prevPageNum, ok := prev_leaf(pager, leftPageNum); ok {
+		prevNode := get_page_for_write(pager, prevPageNum).data
+		set_leaf_node_next_leaf(prevNode, rightPageNum)
+	}
+	right = get_page_for_write(pager, rightPageNum).data
+	write_leaf_cells(right, append(leaf_node_cells(left), leaf_node_cells(right)...))
+	// Dropping the left child also drops the separator between the two.
+	internal_node_remove_child(table, parentPageNum, leftPageNum)
+	free_page(pager, leftPageNum)
+	log.Printf("INFO: leaf_node_merge: Merged leaf page %d into page %d\n", leftPageNum, rightPageNum)
+}
+
+// internal_node_remove_child drops a child pointer from an internal node.
+// An internal node may be left with zero keys and only a right child; one
+// that loses its last child is removed from its own parent, and a root left
+// with a single child absorbs that child so the tree gets one level shorter.
+func internal_node_remove_child(table *Table, pageNum uint32, childPageNum uint32) {
+	pager := table.pager
+	node := get_page_for_write(pager, pageNum).data
+	numKeys := internal_node_num_keys(node)
+
+	if numKeys == 0 {
+		if is_node_root(node) {
+			log.Fatalf("ERROR: internal_node_remove_child: Root page %d has no children left\n", pageNum)
+		}
+		internal_node_remove_child(table, node_parent(node), pageNum)
+		free_page(pager, pageNum)
+		return
+	}
+
+	childIndex := internal_node_child_index(node, childPageNum)
+	children := make([]uint32, 0, numKeys)
+	keys := make([]int64, 0, numKeys-1)
+	for i := uint32(0); i <= numKeys; i++ {
+		if i != childIndex {
+			children = append(children, internal_node_child(node, i))
+		}
+		// The right child has no key of its own, so removing it drops
+		// the separator of the child that takes its place.
+		if i < numKeys && i != childIndex && !(childIndex == numKeys && i == numKeys-1) {
+			keys = append(keys, internal_node_key(node, i))
+		}
+	}
+	write_internal_node(node, children, keys)
+
+	if len(keys) == 0 && is_node_root(node) {
+		collapse_root(table)
+	}
+}
+
+// collapse_root replaces a root with a single child by that child. The root
+// page number never changes, so the child's content is copied into it.
+func collapse_root(table *Table) {
+	pager := table.pager
+	root := get_page_for_write(pager, table.root_page_num).data
+	childPageNum := internal_node_right_child(root)
+	child := get_page(pager, childPageNum).data
+
+	copy(root, child)
+	set_node_root(root, true)
+	if get_node_type(root) == NODE_INTERNAL {
+		for i := uint32(0); i <= internal_node_num_keys(root); i++ {
+			grandchild := get_page_for_write(pager, internal_node_child(root, i)).data
+			set_node_parent(grandchild, table.root_page_num)
+		}
+	}
+	free_page(pager, childPageNum)
+	log.Printf("INFO: collapse_root: Moved page %d into the root\n", childPageNum)
+}
+
+// create_new_root handles splitting the root. The old root's content is
+// copied to a new page which becomes the left child, and the root page is
+// reinitialized as an internal node with two children, so the root page
+// number never changes.
+func create_new_root(table *Table, separator int64, rightChildPageNum uint32) {
+	pager := table.pager
+	root := get_page_for_write(pager, table.root_page_num).data
+	rightChild := get_page_for_write(pager, rightChildPageNum).data
+	leftChildPageNum := get_unused_page_num(pager)
+	leftChild := get_page_for_write(pager, leftChildPageNum).data
+
+	copy(leftChild, root)
+	set_node_root(leftChild, false)
+	if get_node_type(leftChild) == NODE_INTERNAL {
+		for i := uint32(0); i <= internal_node_num_keys(leftChild); i++ {
+			child := get_page_for_write(pager, internal_node_child(leftChild, i)).data
+			set_node_parent(child, leftChildPageNum)
+		}
+	}
+
+	initialize_internal_node(root)
+	set_node_root(root, true)
+	set_internal_node_num_keys(root, 1)
+	set_internal_node_child(root, 0, leftChildPageNum)
+	set_internal_node_key(root, 0, separator)
+	set_internal_node_right_child(root, rightChildPageNum)
+	set_node_parent(leftChild, table.root_page_num)
+	set_node_parent(rightChild, table.root_page_num)
+	log.Printf("INFO: create_new_root: New root with children %d and %d\n", leftChildPageNum, rightChildPageNum)
+}
+
+// internal_node_insert registers rightChildPageNum as the sibling directly
+// after leftChildPageNum in the parent, splitting the parent if it is full.
+func internal_node_insert(table *Table, parentPageNum uint32, leftChildPageNum uint32, separator int64, rightChildPageNum uint32) {
+	pager := table.pager
+	parent := get_page_for_write(pager, parentPageNum).data
+	numKeys := internal_node_num_keys(parent)
+
+	children := make([]uint32, 0, numKeys+2)
+	keys := make([]int64, 0, numKeys+1)
+	for i := uint32(0); i <= numKeys; i++ {
+		child := internal_node_child(parent, i)
+		children = append(children, child)
+		if child == leftChildPageNum {
+			children = append(children, rightChildPageNum)
+			keys = append(keys, separator)
+		}
+		if i < numKeys {
+			keys = append(keys, internal_node_key(parent, i))
+		}
+	}
+	if len(children) != int(numKeys)+2 {
+		log.Fatalf("ERROR: internal_node_insert: Page %d is not a child of page %d\n", leftChildPageNum, parentPageNum)
+	}
+
+	if uint32(len(keys)) <= internal_node_max_keys(pager.page_size) {
+		write_internal_node(parent, children, keys)
+		return
+	}
+
+	// Split: the left half stays in place, the right half moves to a new
+	// page and the middle key moves up to the grandparent.
+	splitIndex := len(keys) / 2
+	promoted := keys[splitIndex]
+	newPageNum := get_unused_page_num(pager)
+	newNode := get_page_for_write(pager, newPageNum).data
+	initialize_internal_node(newNode)
+	set_node_parent(newNode, node_parent(parent))
+
+	write_internal_node(parent, children[:splitIndex+1], keys[:splitIndex])
+	write_internal_node(newNode, children[splitIndex+1:], keys[splitIndex+1:])
+	for _, child := range children[splitIndex+1:] {
+		set_node_parent(get_page_for_write(pager, child).data, newPageNum)
+	}
+	log.Printf("INFO: internal_node_insert: Split internal page %d into %d and %d\n", parentPageNum, parentPageNum, newPageNum)
+
+	if is_node_root(parent) {
+		create_new_root(table, promoted, newPageNum)
+	} else {
+		internal_node_insert(table, node_parent(parent), parentPageNum, promoted, newPageNum)
+	}
+}
+
+// write_internal_node overwrites the cells of an internal node, the last
+// entry of children becomes the right child.
+func write_internal_node(node []byte, children []uint32, keys []int64) {
+	set_internal_node_num_keys(node, uint32(len(keys)))
+	for i, key := range keys {
+		set_internal_node_child(node, uint32(i), children[i])
+		set_internal_node_key(node, uint32(i), key)
+	}
+	set_internal_node_right_child(node, children[len(children)-1])
+}
+
+func indent(level uint32) string {
+	return strings.Repeat("  ", int(level))
+}
+
+func print_tree(pager *Pager, pageNum uint32, indentationLevel uint32) {
+	node := get_page(pager, pageNum).data
+	switch get_node_type(node) {
+	case NODE_LEAF:
+		numCells := leaf_node_num_cells(node)
+		fmt.Printf("%s- leaf (size %d)\n", indent(indentationLevel), numCells)
+		for i := uint32(0); i < numCells; i++ {
+			fmt.Printf("%s- %d\n", indent(indentationLevel+1), leaf_node_key(node, i))
+		}
+	case NODE_INTERNAL:
+		numKeys := internal_node_num_keys(node)
+		fmt.Printf("%s- internal (size %d)\n", indent(indentationLevel), numKeys)
+		for i := uint32(0); i < numKeys; i++ {
+			print_tree(pager, internal_node_child(node, i), indentationLevel+1)
+			fmt.Printf("%s- key %d\n", indent(indentationLevel+1), internal_node_key(node, i))
+		}
+		print_tree(pager, internal_node_right_child(node), indentationLevel+1)
+	}
+}
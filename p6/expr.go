@@ -0,0 +1,724 @@
+package main
+
+import (
+	"cmp"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type ValueType int
+
+const (
+	VALUE_NULL ValueType = iota
+	VALUE_INTEGER
+	VALUE_REAL
+	VALUE_TEXT
+	VALUE_BLOB
+)
+
+// Value is a value of one of SQLite's storage classes, stored in a row or
+// the result of evaluating an expression. Truth values are integers 0 and
+// 1, and NULL stands for unknown as in SQL.
+type Value struct {
+	vt      ValueType
+	integer int64
+	real    float64
+	text    string // VALUE_TEXT, and the bytes of VALUE_BLOB
+}
+
+func null_value() Value {
+	return Value{vt: VALUE_NULL}
+}
+
+func integer_value(integer int64) Value {
+	return Value{vt: VALUE_INTEGER, integer: integer}
+}
+
+func real_value(real float64) Value {
+	return Value{vt: VALUE_REAL, real: real}
+}
+
+func text_value(text string) Value {
+	return Value{vt: VALUE_TEXT, text: text}
+}
+
+func blob_value(blob string) Value {
+	return Value{vt: VALUE_BLOB, text: blob}
+}
+
+func bool_value(b bool) Value {
+	if b {
+		return integer_value(1)
+	}
+	return integer_value(0)
+}
+
+// value_is_true follows SQL: NULL is not true, text counts by its numeric
+// prefix, so 'abc' is false and '1x' is true.
+func value_is_true(value Value) bool {
+	switch value.vt {
+	case VALUE_INTEGER:
+		return value.integer != 0
+	case VALUE_NULL:
+		return false
+	}
+	return value_to_real(value) != 0
+}
+
+// numeric_prefix returns the longest start of text that reads as a number,
+// and whether that number has a fraction or exponent.
+func numeric_prefix(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	end := 0
+	if end < len(text) && (text[end] == '-' || text[end] == '+') {
+		end += 1
+	}
+	digits := end
+	for end < len(text) && is_digit(text[end]) {
+		end += 1
+	}
+	real := false
+	if end < len(text) && text[end] == '.' {
+		fraction := end + 1
+		for fraction < len(text) && is_digit(text[fraction]) {
+			fraction += 1
+		}
+		if fraction-digits > 1 {
+			end, real = fraction, true
+		}
+	}
+	if end > digits && end < len(text) && (text[end] == 'e' || text[end] == 'E') {
+		exponent := end + 1
+		if exponent < len(text) && (text[exponent] == '-' || text[exponent] == '+') {
+			exponent += 1
+		}
+		if exponent < len(text) && is_digit(text[exponent]) {
+			for exponent < len(text) && is_digit(text[exponent]) {
+				exponent += 1
+			}
+			end, real = exponent, true
+		}
+	}
+	return text[:end], real
+}
+
+// text_to_number converts text that is a well-formed number as a whole,
+// surrounding spaces aside, to an integer or a real. This is what numeric
+// affinity does to text.
+func text_to_number(text string) (Value, bool) {
+	prefix, real := numeric_prefix(text)
+	if prefix == "" || prefix != strings.TrimSpace(text) {
+		return Value{}, false
+	}
+	if !real {
+		if integer, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+			return integer_value(integer), true
+		}
+	}
+	number, err := strconv.ParseFloat(prefix, 64)
+	if err != nil && !math.IsInf(number, 0) {
+		return Value{}, false
+	}
+	return real_value(number), true
+}
+
+// numeric_value converts text and blobs to a number by their numeric
+// prefix, as arithmetic does, so '12ab' is 12 and 'abc' is 0.
+func numeric_value(value Value) Value {
+	if value.vt != VALUE_TEXT && value.vt != VALUE_BLOB {
+		return value
+	}
+	prefix, _ := numeric_prefix(value.text)
+	if number, ok := text_to_number(prefix); ok {
+		return number
+	}
+	return integer_value(0)
+}
+
+func is_numeric(value Value) bool {
+	return value.vt == VALUE_INTEGER || value.vt == VALUE_REAL
+}
+
+// storage_class_order ranks the storage classes the way SQLite sorts them:
+// NULL, then numbers, then text, then blobs.
+func storage_class_order(value Value) int {
+	switch value.vt {
+	case VALUE_INTEGER, VALUE_REAL:
+		return 1
+	case VALUE_TEXT:
+		return 2
+	case VALUE_BLOB:
+		return 3
+	}
+	return 0
+}
+
+// compare_values orders two values. Integers and reals compare by value,
+// text and blobs byte by byte.
+func compare_values(a Value, b Value) int {
+	if classA, classB := storage_class_order(a), storage_class_order(b); classA != classB {
+		return cmp.Compare(classA, classB)
+	}
+	switch {
+	case a.vt == VALUE_INTEGER && b.vt == VALUE_INTEGER:
+		return cmp.Compare(a.integer, b.integer)
+	case is_numeric(a):
+		return cmp.Compare(value_to_real(a), value_to_real(b))
+	case a.vt == VALUE_NULL:
+		return 0
+	}
+	return strings.Compare(a.text, b.text)
+}
+
+func value_to_text(value Value) string {
+	switch value.vt {
+	case VALUE_INTEGER:
+		return strconv.FormatInt(value.integer, 10)
+	case VALUE_REAL:
+		// Like SQLite, a real keeps a decimal point even when it is whole.
+		text := strconv.FormatFloat(value.real, 'g', 15, 64)
+		if !strings.ContainsAny(text, ".eIN") {
+			text += ".0"
+		}
+		return text
+	case VALUE_TEXT, VALUE_BLOB:
+		return value.text
+	}
+	return ""
+}
+
+// value_expr turns a value back into a literal.
+func value_expr(value Value, pos int) *Expr {
+	switch value.vt {
+	case VALUE_INTEGER:
+		return &Expr{et: EXPR_INTEGER, pos: pos, integer: value.integer}
+	case VALUE_REAL:
+		return &Expr{et: EXPR_REAL, pos: pos, real: value.real}
+	case VALUE_TEXT:
+		return &Expr{et: EXPR_STRING, pos: pos, text: value.text}
+	case VALUE_BLOB:
+		return &Expr{et: EXPR_BLOB, pos: pos, text: value.text}
+	}
+	return &Expr{et: EXPR_NULL, pos: pos}
+}
+
+func type_name(vt ValueType) string {
+	return [...]string{"null", "integer", "real", "text", "blob"}[vt]
+}
+
+// SqlFunction is a scalar function callable from expressions.
+type SqlFunction struct {
+	min_args int
+	max_args int // -1 for any number
+	call     func(args []Value) Value
+}
+
+var FUNCTIONS map[string]SqlFunction
+
+func init() {
+	FUNCTIONS = map[string]SqlFunction{
+		"abs": {1, 1, func(args []Value) Value {
+			if args[0].vt == VALUE_NULL {
+				return args[0]
+			}
+			number := numeric_value(args[0])
+			if number.vt == VALUE_REAL {
+				return real_value(math.Abs(number.real))
+			}
+			if number.integer == math.MinInt64 {
+				eval_fail("integer overflow")
+			}
+			return integer_value(abs(number.integer))
+		}},
+		"coalesce": {2, -1, func(args []Value) Value {
+			for _, arg := range args {
+				if arg.vt != VALUE_NULL {
+					return arg
+				}
+			}
+			return null_value()
+		}},
+		"hex": {1, 1, func(args []Value) Value {
+			return text_value(strings.ToUpper(hex.EncodeToString([]byte(value_to_text(args[0])))))
+		}},
+		"ifnull": {2, 2, func(args []Value) Value {
+			if args[0].vt != VALUE_NULL {
+				return args[0]
+			}
+			return args[1]
+		}},
+		"instr": {2, 2, func(args []Value) Value {
+			if args[0].vt == VALUE_NULL || args[1].vt == VALUE_NULL {
+				return null_value()
+			}
+			index := strings.Index(value_to_text(args[0]), value_to_text(args[1]))
+			if index < 0 {
+				return integer_value(0)
+			}
+			return integer_value(int64(utf8.RuneCountInString(value_to_text(args[0])[:index])) + 1)
+		}},
+		"length": {1, 1, func(args []Value) Value {
+			if args[0].vt == VALUE_NULL {
+				return args[0]
+			}
+			if args[0].vt == VALUE_BLOB {
+				return integer_value(int64(len(args[0].text)))
+			}
+			return integer_value(int64(utf8.RuneCountInString(value_to_text(args[0]))))
+		}},
+		"lower": {1, 1, func(args []Value) Value {
+			if args[0].vt == VALUE_NULL {
+				return args[0]
+			}
+			return text_value(strings.ToLower(value_to_text(args[0])))
+		}},
+		"substr": {2, 3, sql_substr},
+		"trim": {1, 1, func(args []Value) Value {
+			if args[0].vt == VALUE_NULL {
+				return args[0]
+			}
+			return text_value(strings.Trim(value_to_text(args[0]), " "))
+		}},
+		"typeof": {1, 1, func(args []Value) Value {
+			return text_value(type_name(args[0].vt))
+		}},
+		"upper": {1, 1, func(args []Value) Value {
+			if args[0].vt == VALUE_NULL {
+				return args[0]
+			}
+			return text_value(strings.ToUpper(value_to_text(args[0])))
+		}},
+	}
+}
+
+// sql_substr is substr(text, start[, length]) with 1-based positions, a
+// negative start counts from the end and a negative length takes the
+// characters before start.
+func sql_substr(args []Value) Value {
+	for _, arg := range args {
+		if arg.vt == VALUE_NULL {
+			return null_value()
+		}
+	}
+	runes := []rune(value_to_text(args[0]))
+	length := int64(len(runes))
+	p1 := value_to_integer(args[1])
+	p2 := length
+	if len(args) == 3 {
+		p2 = value_to_integer(args[2])
+	}
+	negativeLength := p2 < 0
+	if negativeLength {
+		// -MinInt64 does not fit, one less takes every character as well.
+		p2 = -max(p2, -math.MaxInt64)
+	}
+
+	if p1 < 0 {
+		p1 += length
+		if p1 < 0 {
+			p2 = max(p2+p1, 0)
+			p1 = 0
+		}
+	} else if p1 > 0 {
+		p1 -= 1
+	} else if p2 > 0 {
+		// Position 0 is just before the first character.
+		p2 -= 1
+	}
+	// p2 is not negative from here on, so neither step below can overflow:
+	// p1 is not negative when p2 is taken off and negative when it is added.
+	if negativeLength {
+		p1 -= p2
+		if p1 < 0 {
+			p2 += p1
+			p1 = 0
+		}
+	}
+	if p1 >= length {
+		return text_value("")
+	}
+	return text_value(string(runes[p1 : p1+min(p2, length-p1)]))
+}
+
+// add_integers, subtract_integers and multiply_integers report whether the
+// result fits in 64 bits.
+func add_integers(x int64, y int64) (int64, bool) {
+	sum := x + y
+	return sum, (sum > x) == (y > 0)
+}
+
+func subtract_integers(x int64, y int64) (int64, bool) {
+	if y == math.MinInt64 {
+		return x - y, x < 0
+	}
+	return add_integers(x, -y)
+}
+
+func multiply_integers(x int64, y int64) (int64, bool) {
+	product := x * y
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	if (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+		return product, false
+	}
+	return product, product/y == x
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// value_to_integer converts text by its numeric prefix, so '12ab' is 12.
+func value_to_integer(value Value) int64 {
+	value = numeric_value(value)
+	switch value.vt {
+	case VALUE_INTEGER:
+		return value.integer
+	case VALUE_REAL:
+		return int64(value.real)
+	}
+	return 0
+}
+
+func value_to_real(value Value) float64 {
+	value = numeric_value(value)
+	switch value.vt {
+	case VALUE_INTEGER:
+		return float64(value.integer)
+	case VALUE_REAL:
+		return value.real
+	}
+	return 0
+}
+
+// resolve_expr checks that every column an expression refers to exists in
+// columns and records its index, so eval_expr does not look names up per
+// row. It also checks function names and argument counts. Expressions
+// evaluated without a row pass nil columns.
+func resolve_expr(expr *Expr, columns []string) *SyntaxError {
+	if expr == nil {
+		return nil
+	}
+	switch expr.et {
+	case EXPR_COLUMN:
+		for i, name := range columns {
+			if strings.EqualFold(name, expr.text) {
+				expr.column = i
+				return nil
+			}
+		}
+		return &SyntaxError{expr.pos, fmt.Sprintf("no such column: %s", expr.text)}
+	case EXPR_AGGREGATE:
+		// Resolved by collect_aggregates.
+		return nil
+	case EXPR_FUNCTION:
+		if _, ok := AGGREGATES[expr.text]; ok {
+			return &SyntaxError{expr.pos, fmt.Sprintf("misuse of aggregate function %s()", expr.text)}
+		}
+		function, ok := FUNCTIONS[expr.text]
+		if !ok {
+			return &SyntaxError{expr.pos, fmt.Sprintf("no such function: %s", expr.text)}
+		}
+		if len(expr.args) < function.min_args || (function.max_args >= 0 && len(expr.args) > function.max_args) {
+			return &SyntaxError{expr.pos, fmt.Sprintf("wrong number of arguments to function %s()", expr.text)}
+		}
+	}
+	if err := resolve_expr(expr.left, columns); err != nil {
+		return err
+	}
+	if err := resolve_expr(expr.right, columns); err != nil {
+		return err
+	}
+	for _, arg := range expr.args {
+		if err := resolve_expr(arg, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EvalError is raised with panic while an expression is evaluated, for a
+// value that cannot be computed, such as a sum() past the 64-bit range.
+type EvalError struct {
+	msg string
+}
+
+func (e *EvalError) Error() string {
+	return e.msg
+}
+
+func eval_fail(format string, args ...any) {
+	panic(&EvalError{fmt.Sprintf(format, args...)})
+}
+
+// eval_constant evaluates a constant expression while a statement is
+// prepared, an EvalError comes back as a syntax error at the expression.
+func eval_constant(expr *Expr) (value Value, err *SyntaxError) {
+	defer func() {
+		if r := recover(); r != nil {
+			evalError, isEvalError := r.(*EvalError)
+			if !isEvalError {
+				panic(r)
+			}
+			err = &SyntaxError{expr.pos, evalError.msg}
+		}
+	}()
+	return eval_expr(expr, nil), nil
+}
+
+// eval_expr evaluates expr against row, which holds the values of the
+// columns resolve_expr was given. row is nil for constant expressions.
+func eval_expr(expr *Expr, row []Value) Value {
+	switch expr.et {
+	case EXPR_INTEGER:
+		return integer_value(expr.integer)
+	case EXPR_REAL:
+		return real_value(expr.real)
+	case EXPR_STRING:
+		return text_value(expr.text)
+	case EXPR_BLOB:
+		return blob_value(expr.text)
+	case EXPR_NULL:
+		return null_value()
+	case EXPR_COLUMN, EXPR_AGGREGATE:
+		return row[expr.column]
+	case EXPR_UNARY:
+		operand := eval_expr(expr.left, row)
+		if operand.vt == VALUE_NULL {
+			return operand
+		}
+		if expr.op == "-" {
+			operand = numeric_value(operand)
+			if operand.vt == VALUE_REAL {
+				return real_value(-operand.real)
+			}
+			if operand.integer == math.MinInt64 {
+				return real_value(-float64(operand.integer))
+			}
+			return integer_value(-operand.integer)
+		}
+		return bool_value(!value_is_true(operand))
+	case EXPR_BINARY:
+		return eval_binary(expr, row)
+	case EXPR_BETWEEN:
+		value := eval_expr(expr.left, row)
+		lower := compare_op(">=", value, eval_expr(expr.args[0], row))
+		upper := compare_op("<=", value, eval_expr(expr.args[1], row))
+		return and_values(lower, upper)
+	case EXPR_IN:
+		value := eval_expr(expr.left, row)
+		if value.vt == VALUE_NULL {
+			return value
+		}
+		sawNull := false
+		for _, arg := range expr.args {
+			candidate := eval_expr(arg, row)
+			if candidate.vt == VALUE_NULL {
+				sawNull = true
+			} else if compare_values(value, candidate) == 0 {
+				return bool_value(true)
+			}
+		}
+		if sawNull {
+			return null_value()
+		}
+		return bool_value(false)
+	case EXPR_IS_NULL:
+		return bool_value(eval_expr(expr.left, row).vt == VALUE_NULL)
+	case EXPR_FUNCTION:
+		args := make([]Value, len(expr.args))
+		for i, arg := range expr.args {
+			args[i] = eval_expr(arg, row)
+		}
+		return FUNCTIONS[expr.text].call(args)
+	}
+	return null_value()
+}
+
+func eval_binary(expr *Expr, row []Value) Value {
+	left := eval_expr(expr.left, row)
+	switch expr.op {
+	case "AND":
+		if left.vt != VALUE_NULL && !value_is_true(left) {
+			return bool_value(false)
+		}
+		return and_values(left, eval_expr(expr.right, row))
+	case "OR":
+		if value_is_true(left) {
+			return bool_value(true)
+		}
+		right := eval_expr(expr.right, row)
+		if value_is_true(right) {
+			return bool_value(true)
+		}
+		if left.vt == VALUE_NULL || right.vt == VALUE_NULL {
+			return null_value()
+		}
+		return bool_value(false)
+	case "LIKE":
+		right := eval_expr(expr.right, row)
+		if left.vt == VALUE_NULL || right.vt == VALUE_NULL {
+			return null_value()
+		}
+		return bool_value(like_match(value_to_text(right), value_to_text(left)))
+	case "+", "-", "*", "/", "%", "||":
+		return arithmetic_op(expr.op, left, eval_expr(expr.right, row))
+	}
+	return compare_op(expr.op, left, eval_expr(expr.right, row))
+}
+
+// and_values is three-valued AND: false wins over NULL, NULL over true.
+func and_values(a Value, b Value) Value {
+	if (a.vt != VALUE_NULL && !value_is_true(a)) || (b.vt != VALUE_NULL && !value_is_true(b)) {
+		return bool_value(false)
+	}
+	if a.vt == VALUE_NULL || b.vt == VALUE_NULL {
+		return null_value()
+	}
+	return bool_value(true)
+}
+
+func compare_op(op string, a Value, b Value) Value {
+	if a.vt == VALUE_NULL || b.vt == VALUE_NULL {
+		return null_value()
+	}
+	c := compare_values(a, b)
+	switch op {
+	case "=":
+		return bool_value(c == 0)
+	case "!=":
+		return bool_value(c != 0)
+	case "<":
+		return bool_value(c < 0)
+	case "<=":
+		return bool_value(c <= 0)
+	case ">":
+		return bool_value(c > 0)
+	case ">=":
+		return bool_value(c >= 0)
+	}
+	return null_value()
+}
+
+// arithmetic_op works on integers unless either operand is real, text
+// operands are converted by their numeric prefix. As in SQLite an integer
+// result that does not fit in 64 bits is computed as a real instead.
+// Division by zero gives NULL.
+func arithmetic_op(op string, a Value, b Value) Value {
+	if a.vt == VALUE_NULL || b.vt == VALUE_NULL {
+		return null_value()
+	}
+	if op == "||" {
+		return text_value(value_to_text(a) + value_to_text(b))
+	}
+	a, b = numeric_value(a), numeric_value(b)
+	if a.vt == VALUE_REAL || b.vt == VALUE_REAL {
+		return real_arithmetic_op(op, value_to_real(a), value_to_real(b))
+	}
+	x, y := a.integer, b.integer
+	var result int64
+	ok := true
+	switch op {
+	case "+":
+		result, ok = add_integers(x, y)
+	case "-":
+		result, ok = subtract_integers(x, y)
+	case "*":
+		result, ok = multiply_integers(x, y)
+	case "/":
+		if y == 0 {
+			return null_value()
+		}
+		result, ok = x/y, x != math.MinInt64 || y != -1
+	case "%":
+		if y == 0 {
+			return null_value()
+		}
+		result = x % y
+	default:
+		return null_value()
+	}
+	if !ok {
+		return real_arithmetic_op(op, float64(x), float64(y))
+	}
+	return integer_value(result)
+}
+
+func real_arithmetic_op(op string, x float64, y float64) Value {
+	switch op {
+	case "+":
+		return real_value(x + y)
+	case "-":
+		return real_value(x - y)
+	case "*":
+		return real_value(x * y)
+	case "/":
+		if y == 0 {
+			return null_value()
+		}
+		return real_value(x / y)
+	case "%":
+		if int64(y) == 0 {
+			return null_value()
+		}
+		return real_value(float64(int64(x) % int64(y)))
+	}
+	return null_value()
+}
+
+// value_to_display is how values are printed in query results.
+func value_to_display(value Value) string {
+	if value.vt == VALUE_NULL {
+		return "NULL"
+	}
+	return value_to_text(value)
+}
+
+// like_match implements LIKE: % matches any run of characters, _ matches
+// exactly one, and ASCII letters match regardless of case.
+func like_match(pattern string, text string) bool {
+	p, t := []rune(pattern), []rune(text)
+	// Positions to retry from when a later part of the pattern fails after a %.
+	starP, starT := -1, 0
+	i, j := 0, 0
+	for j < len(t) {
+		switch {
+		case i < len(p) && p[i] == '%':
+			starP, starT = i, j
+			i += 1
+		case i < len(p) && (p[i] == '_' || fold_ascii(p[i]) == fold_ascii(t[j])):
+			i += 1
+			j += 1
+		case starP >= 0:
+			starT += 1
+			i, j = starP+1, starT
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '%' {
+		i += 1
+	}
+	return i == len(p)
+}
+
+func fold_ascii(r rune) rune {
+	if r >= 'A' && r <= 'Z' {
+		return r + 'a' - 'A'
+	}
+	return r
+}
+
+// row_matches reports whether row passes the WHERE clause, a nil clause
+// matches every row.
+func row_matches(where *Expr, row []Value) bool {
+	return where == nil || value_is_true(eval_expr(where, row))
+}
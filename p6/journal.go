@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/*
+ * Rollback Journal Layout. Before a page of the database file is changed
+ * its original content is appended to <db>-journal. The journal is synced
+ * before any page is written in place and deleted once all of them are, so
+ * a journal that is still there when the file is opened means the last
+ * transaction did not finish, and copying its pages back undoes it.
+ */
+const (
+	JOURNAL_SUFFIX            = "-journal"
+	JOURNAL_MAGIC             = "GoDB journal"
+	JOURNAL_MAGIC_SIZE        = 12
+	JOURNAL_PAGE_SIZE_OFFSET  = JOURNAL_MAGIC_SIZE
+	JOURNAL_PAGE_COUNT_OFFSET = JOURNAL_PAGE_SIZE_OFFSET + 4
+	JOURNAL_CHECKSUM_OFFSET   = JOURNAL_PAGE_COUNT_OFFSET + 4
+	JOURNAL_HEADER_SIZE       = JOURNAL_CHECKSUM_OFFSET + 4
+)
+
+// A record is the page number, the page and a checksum of both, so a
+// record that was only partly written is recognized.
+const (
+	JOURNAL_RECORD_PAGE_NUM_SIZE = 4
+	JOURNAL_RECORD_CHECKSUM_SIZE = 4
+)
+
+func journal_record_size(pageSize uint32) int64 {
+	return JOURNAL_RECORD_PAGE_NUM_SIZE + int64(pageSize) + JOURNAL_RECORD_CHECKSUM_SIZE
+}
+
+// journal_begin starts the journal of a transaction. Pages past the end of
+// the file at this point are new and are never journaled, undoing the
+// transaction cuts them off.
+func journal_begin(pager *Pager) {
+	filename := pager.file_descriptor.Name() + JOURNAL_SUFFIX
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatalf("ERROR: journal_begin: Could not create journal %s: %v\n", filename, err)
+	}
+	pager.journal_file = f
+	pager.journal_page_count = uint32(pager.file_length / int64(pager.page_size))
+	pager.journaled = make(map[uint32]bool)
+	pager.journal_synced = false
+
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	copy(header, JOURNAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[JOURNAL_PAGE_SIZE_OFFSET:], pager.page_size)
+	binary.LittleEndian.PutUint32(header[JOURNAL_PAGE_COUNT_OFFSET:], pager.journal_page_count)
+	binary.LittleEndian.PutUint32(header[JOURNAL_CHECKSUM_OFFSET:], crc32.ChecksumIEEE(header[:JOURNAL_CHECKSUM_OFFSET]))
+	if _, err := f.Write(header); err != nil {
+		log.Fatalf("ERROR: journal_begin: Could not write journal %s: %v\n", filename, err)
+	}
+	log.Printf("INFO: journal_begin: Started journal %s for %d pages\n", filename, pager.journal_page_count)
+}
+
+// journal_page saves the original content of a page the first time it is
+// changed in a transaction.
+func journal_page(pager *Pager, page *Page) {
+	if pager.journal_file == nil {
+		journal_begin(pager)
+	}
+	if page.page_num >= pager.journal_page_count || pager.journaled[page.page_num] {
+		return
+	}
+	record := binary.LittleEndian.AppendUint32(nil, page.page_num)
+	record = append(record, page.data...)
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+	if _, err := pager.journal_file.Write(record); err != nil {
+		log.Fatalf("ERROR: journal_page: Could not write page %d to the journal: %v\n", page.page_num, err)
+	}
+	pager.journaled[page.page_num] = true
+	pager.journal_synced = false
+}
+
+// journal_sync makes sure the journal is on disk before a page it holds is
+// overwritten in the database file.
+func journal_sync(pager *Pager) {
+	if pager.journal_file == nil || pager.journal_synced {
+		return
+	}
+	if err := pager.journal_file.Sync(); err != nil {
+		log.Fatalf("ERROR: journal_sync: Could not sync the journal: %v\n", err)
+	}
+	// The journal itself has to be found after a crash.
+	if err := sync_file(filepath.Dir(pager.journal_file.Name())); err != nil {
+		log.Printf("WARNING: journal_sync: %v\n", err)
+	}
+	pager.journal_synced = true
+}
+
+// journal_end deletes the journal, which commits the transaction.
+func journal_end(pager *Pager) {
+	filename := pager.journal_file.Name()
+	pager.journal_file.Close()
+	if err := os.Remove(filename); err != nil {
+		log.Fatalf("ERROR: journal_end: Could not delete journal %s: %v\n", filename, err)
+	}
+	pager.journal_file = nil
+	pager.journaled = nil
+	log.Printf("INFO: journal_end: Deleted journal %s\n", filename)
+}
+
+// journal_recover undoes an unfinished transaction on the database file f
+// by writing back the pages saved in its journal. A journal with a header
+// that was not completely written was never synced, so the database file
+// was not changed yet and the journal is just deleted.
+func journal_recover(f *os.File) error {
+	filename := f.Name() + JOURNAL_SUFFIX
+	journal, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open journal %s: %v", filename, err)
+	}
+	defer journal.Close()
+
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	if _, err := io.ReadFull(journal, header); err != nil ||
+		string(header[:JOURNAL_MAGIC_SIZE]) != JOURNAL_MAGIC ||
+		binary.LittleEndian.Uint32(header[JOURNAL_CHECKSUM_OFFSET:]) != crc32.ChecksumIEEE(header[:JOURNAL_CHECKSUM_OFFSET]) {
+		log.Printf("WARNING: journal_recover: Journal %s is incomplete, the database was not changed\n", filename)
+		return os.Remove(filename)
+	}
+	if err := journal_playback(journal, f); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// journal_rollback undoes the current transaction on the database file and
+// deletes its journal. Pages still in the cache are not written back, the
+// caller drops them.
+func journal_rollback(pager *Pager) {
+	if err := journal_playback(pager.journal_file, pager.file_descriptor); err != nil {
+		log.Fatalf("ERROR: journal_rollback: %v\n", err)
+	}
+	pager.file_length = int64(pager.journal_page_count) * int64(pager.page_size)
+	journal_end(pager)
+}
+
+// journal_playback writes the pages saved in a journal back to the
+// database file f, up to the first record that is not complete, and cuts
+// off the pages the transaction added.
+func journal_playback(journal *os.File, f *os.File) error {
+	filename := journal.Name()
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	if _, err := journal.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("could not read journal %s: %v", filename, err)
+	}
+	pageSize := binary.LittleEndian.Uint32(header[JOURNAL_PAGE_SIZE_OFFSET:])
+	pageCount := binary.LittleEndian.Uint32(header[JOURNAL_PAGE_COUNT_OFFSET:])
+	if !is_valid_page_size(pageSize) {
+		return fmt.Errorf("journal %s is corrupt: page size %d", filename, pageSize)
+	}
+
+	record := make([]byte, journal_record_size(pageSize))
+	numRestored := 0
+	for offset := int64(JOURNAL_HEADER_SIZE); ; offset += int64(len(record)) {
+		// The last record may have been cut short by a crash.
+		if _, err := journal.ReadAt(record, offset); err != nil {
+			break
+		}
+		checksumOffset := len(record) - JOURNAL_RECORD_CHECKSUM_SIZE
+		if binary.LittleEndian.Uint32(record[checksumOffset:]) != crc32.ChecksumIEEE(record[:checksumOffset]) {
+			break
+		}
+		pageNum := binary.LittleEndian.Uint32(record)
+		if _, err := f.WriteAt(record[JOURNAL_RECORD_PAGE_NUM_SIZE:checksumOffset], int64(pageNum)*int64(pageSize)); err != nil {
+			return fmt.Errorf("could not restore page %d from journal %s: %v", pageNum, filename, err)
+		}
+		numRestored++
+	}
+	if err := f.Truncate(int64(pageCount) * int64(pageSize)); err != nil {
+		return fmt.Errorf("could not restore the size of %s: %v", f.Name(), err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %v", f.Name(), err)
+	}
+	log.Printf("INFO: journal_playback: Restored %d pages of %s from its journal\n", numRestored, f.Name())
+	return nil
+}
+
+/*
+ * Statement Journal. Inside a transaction the original content of every
+ * page a statement changes is appended to a temporary file, each record
+ * being the page number and the page, so a statement that fails can be
+ * undone without holding its pages in memory. The file is only needed
+ * while the database is open, so it is deleted right after it is created.
+ */
+const STATEMENT_JOURNAL_PAGE_NUM_SIZE = 4
+
+// statement_journal_page saves the original content of a page the first
+// time the current statement changes it.
+func statement_journal_page(pager *Pager, page *Page) {
+	if pager.statement_file == nil {
+		// Next to the database rather than in the temporary directory,
+		// which may be held in memory.
+		filename := pager.file_descriptor.Name()
+		f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+"-stmt-*")
+		if err != nil {
+			log.Fatalf("ERROR: statement_journal_page: Could not create the statement journal: %v\n", err)
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			log.Printf("WARNING: statement_journal_page: Could not delete %s: %v\n", f.Name(), err)
+		}
+		pager.statement_file = f
+	}
+	record := binary.LittleEndian.AppendUint32(nil, page.page_num)
+	record = append(record, page.data...)
+	if _, err := pager.statement_file.WriteAt(record, pager.statement_length); err != nil {
+		log.Fatalf("ERROR: statement_journal_page: Could not write page %d to the statement journal: %v\n", page.page_num, err)
+	}
+	pager.statement_length += int64(len(record))
+	pager.statement_saved[page.page_num] = true
+}
+
+// statement_journal_rollback copies the saved pages back into the cache and
+// returns how many there were.
+func statement_journal_rollback(pager *Pager) int {
+	record := make([]byte, STATEMENT_JOURNAL_PAGE_NUM_SIZE+int64(pager.page_size))
+	numRestored := 0
+	for offset := int64(0); offset < pager.statement_length; offset += int64(len(record)) {
+		if _, err := pager.statement_file.ReadAt(record, offset); err != nil {
+			log.Fatalf("ERROR: statement_journal_rollback: Could not read the statement journal: %v\n", err)
+		}
+		pageNum := binary.LittleEndian.Uint32(record)
+		copy(get_page_for_write(pager, pageNum).data, record[STATEMENT_JOURNAL_PAGE_NUM_SIZE:])
+		pager_release(pager)
+		numRestored++
+	}
+	pager.statement_length = 0
+	return numRestored
+}
+
+// statement_journal_close closes the statement journal once the transaction
+// is over.
+func statement_journal_close(pager *Pager) {
+	if pager.statement_file != nil {
+		pager.statement_file.Close()
+		pager.statement_file = nil
+	}
+	pager.statement_saved = nil
+	pager.statement_length = 0
+}
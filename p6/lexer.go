@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+type TokenType int
+
+const (
+	TOKEN_EOF TokenType = iota
+	TOKEN_KEYWORD
+	TOKEN_IDENTIFIER
+	TOKEN_STRING
+	TOKEN_BLOB
+	TOKEN_NUMBER
+	TOKEN_COMMA
+	TOKEN_SEMICOLON
+	TOKEN_LPAREN
+	TOKEN_RPAREN
+	TOKEN_DOT
+	TOKEN_STAR
+	TOKEN_PLUS
+	TOKEN_MINUS
+	TOKEN_SLASH
+	TOKEN_PERCENT
+	TOKEN_CONCAT
+	TOKEN_EQ
+	TOKEN_NE
+	TOKEN_LT
+	TOKEN_LE
+	TOKEN_GT
+	TOKEN_GE
+)
+
+// Keywords are matched case-insensitively and stored upper case in the
+// token text. Anything else that looks like a name is an identifier.
+var KEYWORDS = map[string]bool{
+	"ADD":         true,
+	"ALTER":       true,
+	"AND":         true,
+	"AS":          true,
+	"ASC":         true,
+	"BEGIN":       true,
+	"BETWEEN":     true,
+	"BY":          true,
+	"COLUMN":      true,
+	"COMMIT":      true,
+	"CREATE":      true,
+	"DEFAULT":     true,
+	"DELETE":      true,
+	"DESC":        true,
+	"DROP":        true,
+	"EXISTS":      true,
+	"FROM":        true,
+	"GROUP":       true,
+	"HAVING":      true,
+	"IF":          true,
+	"IN":          true,
+	"INSERT":      true,
+	"INTO":        true,
+	"IS":          true,
+	"KEY":         true,
+	"LIKE":        true,
+	"LIMIT":       true,
+	"NOT":         true,
+	"NULL":        true,
+	"OFFSET":      true,
+	"OR":          true,
+	"ORDER":       true,
+	"PRAGMA":      true,
+	"PRIMARY":     true,
+	"RENAME":      true,
+	"ROLLBACK":    true,
+	"SELECT":      true,
+	"SET":         true,
+	"TABLE":       true,
+	"TO":          true,
+	"TRANSACTION": true,
+	"UPDATE":      true,
+	"VACUUM":      true,
+	"VALUES":      true,
+	"WHERE":       true,
+}
+
+type Token struct {
+	tt   TokenType
+	text string
+	pos  int // byte offset of the first character in the input
+}
+
+// SyntaxError is returned for input that cannot be lexed or parsed, pos is
+// the byte offset of the offending token.
+type SyntaxError struct {
+	pos int
+	msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.pos+1, e.msg)
+}
+
+// Lexer hands out one token at a time so that a statement can switch to
+// reading raw text part way through, as the shorthand insert does.
+type Lexer struct {
+	input string
+	pos   int
+}
+
+func token_description(token Token) string {
+	switch token.tt {
+	case TOKEN_EOF:
+		return "end of input"
+	case TOKEN_STRING:
+		return fmt.Sprintf("'%s'", token.text)
+	case TOKEN_BLOB:
+		return fmt.Sprintf("X'%X'", token.text)
+	}
+	return fmt.Sprintf("\"%s\"", token.text)
+}
+
+func is_identifier_start(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func is_digit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// skip_whitespace_and_comments moves past spaces, "-- line" comments and
+// "/* block */" comments.
+func skip_whitespace_and_comments(lexer *Lexer) *SyntaxError {
+	input := lexer.input
+	for lexer.pos < len(input) {
+		c := input[lexer.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			lexer.pos += 1
+		case strings.HasPrefix(input[lexer.pos:], "--"):
+			end := strings.IndexByte(input[lexer.pos:], '\n')
+			if end < 0 {
+				lexer.pos = len(input)
+			} else {
+				lexer.pos += end + 1
+			}
+		case strings.HasPrefix(input[lexer.pos:], "/*"):
+			end := strings.Index(input[lexer.pos+2:], "*/")
+			if end < 0 {
+				return &SyntaxError{lexer.pos, "unterminated comment"}
+			}
+			lexer.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func next_token(lexer *Lexer) (Token, *SyntaxError) {
+	if err := skip_whitespace_and_comments(lexer); err != nil {
+		return Token{}, err
+	}
+	input := lexer.input
+	start := lexer.pos
+	if start >= len(input) {
+		return Token{tt: TOKEN_EOF, pos: start}, nil
+	}
+
+	c := input[start]
+	switch {
+	case (c == 'x' || c == 'X') && start+1 < len(input) && input[start+1] == '\'':
+		// X'0A1B' is a blob literal.
+		end := strings.IndexByte(input[start+2:], '\'')
+		if end < 0 {
+			return Token{}, &SyntaxError{start, "unterminated blob literal"}
+		}
+		blob, err := hex.DecodeString(input[start+2 : start+2+end])
+		if err != nil {
+			return Token{}, &SyntaxError{start, "malformed blob literal"}
+		}
+		lexer.pos = start + 2 + end + 1
+		return Token{TOKEN_BLOB, string(blob), start}, nil
+
+	case is_identifier_start(c):
+		end := start + 1
+		for end < len(input) && (is_identifier_start(input[end]) || is_digit(input[end])) {
+			end += 1
+		}
+		lexer.pos = end
+		word := input[start:end]
+		if KEYWORDS[strings.ToUpper(word)] {
+			return Token{TOKEN_KEYWORD, strings.ToUpper(word), start}, nil
+		}
+		return Token{TOKEN_IDENTIFIER, word, start}, nil
+
+	case is_digit(c) || (c == '.' && start+1 < len(input) && is_digit(input[start+1])):
+		end := start
+		for end < len(input) && is_digit(input[end]) {
+			end += 1
+		}
+		if end < len(input) && input[end] == '.' {
+			end += 1
+			for end < len(input) && is_digit(input[end]) {
+				end += 1
+			}
+		}
+		if end < len(input) && (input[end] == 'e' || input[end] == 'E') {
+			exponent := end + 1
+			if exponent < len(input) && (input[exponent] == '+' || input[exponent] == '-') {
+				exponent += 1
+			}
+			if exponent < len(input) && is_digit(input[exponent]) {
+				end = exponent
+				for end < len(input) && is_digit(input[end]) {
+					end += 1
+				}
+			}
+		}
+		if end < len(input) && is_identifier_start(input[end]) {
+			return Token{}, &SyntaxError{start, fmt.Sprintf("malformed number \"%s\"", input[start:end+1])}
+		}
+		lexer.pos = end
+		return Token{TOKEN_NUMBER, input[start:end], start}, nil
+
+	case c == '\'' || c == '"' || c == '`':
+		// '...' is a string, "..." and `...` are quoted identifiers. The
+		// quote character is escaped by doubling it.
+		var text strings.Builder
+		end := start + 1
+		for {
+			if end >= len(input) {
+				if c == '\'' {
+					return Token{}, &SyntaxError{start, "unterminated string"}
+				}
+				return Token{}, &SyntaxError{start, "unterminated quoted identifier"}
+			}
+			if input[end] == c {
+				if end+1 < len(input) && input[end+1] == c {
+					text.WriteByte(c)
+					end += 2
+					continue
+				}
+				break
+			}
+			text.WriteByte(input[end])
+			end += 1
+		}
+		lexer.pos = end + 1
+		if c == '\'' {
+			return Token{TOKEN_STRING, text.String(), start}, nil
+		}
+		return Token{TOKEN_IDENTIFIER, text.String(), start}, nil
+	}
+
+	operators := []struct {
+		text string
+		tt   TokenType
+	}{
+		// Two character operators first so "<=" is not read as "<".
+		{"<=", TOKEN_LE}, {">=", TOKEN_GE}, {"!=", TOKEN_NE}, {"<>", TOKEN_NE},
+		{"==", TOKEN_EQ}, {"||", TOKEN_CONCAT},
+		{",", TOKEN_COMMA}, {";", TOKEN_SEMICOLON}, {"(", TOKEN_LPAREN}, {")", TOKEN_RPAREN},
+		{".", TOKEN_DOT}, {"*", TOKEN_STAR}, {"+", TOKEN_PLUS}, {"-", TOKEN_MINUS},
+		{"/", TOKEN_SLASH}, {"%", TOKEN_PERCENT}, {"=", TOKEN_EQ}, {"<", TOKEN_LT}, {">", TOKEN_GT},
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(input[start:], op.text) {
+			lexer.pos = start + len(op.text)
+			return Token{op.tt, op.text, start}, nil
+		}
+	}
+	return Token{}, &SyntaxError{start, fmt.Sprintf("unexpected character '%c'", c)}
+}
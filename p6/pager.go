@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// New files get DEFAULT_PAGE_SIZE unless -page-size says otherwise, which
+// must be a power of two from MIN_PAGE_SIZE to MAX_PAGE_SIZE. The page size
+// of an existing file is the one in its header.
+const (
+	DEFAULT_PAGE_SIZE = 4096
+	MIN_PAGE_SIZE     = 512
+	MAX_PAGE_SIZE     = 65536
+)
+
+// DEFAULT_CACHE_SIZE is how many pages the pager keeps in memory unless
+// -cache-size says otherwise.
+const DEFAULT_CACHE_SIZE = 2000
+
+/*
+ * File Header Layout. Page 0 holds the header and nothing else, the
+ * catalog starts on page 1.
+ */
+const (
+	HEADER_PAGE_NUM              = 0
+	HEADER_MAGIC                 = "GoDB file format"
+	HEADER_MAGIC_SIZE            = 16
+	HEADER_MAGIC_OFFSET          = 0
+	HEADER_FORMAT_VERSION_OFFSET = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+	HEADER_PAGE_SIZE_OFFSET      = HEADER_FORMAT_VERSION_OFFSET + 4
+	HEADER_PAGE_COUNT_OFFSET     = HEADER_PAGE_SIZE_OFFSET + 4
+	HEADER_FREE_LIST_HEAD_OFFSET = HEADER_PAGE_COUNT_OFFSET + 4
+	HEADER_SCHEMA_COOKIE_OFFSET  = HEADER_FREE_LIST_HEAD_OFFSET + 4
+	HEADER_FREE_PAGES_OFFSET     = HEADER_SCHEMA_COOKIE_OFFSET + 4
+	HEADER_JOURNAL_MODE_OFFSET   = HEADER_FREE_PAGES_OFFSET + 4
+	HEADER_SIZE                  = HEADER_JOURNAL_MODE_OFFSET + 4
+)
+
+// JournalMode says how commits are made safe: by saving the original pages
+// in a rollback journal, see journal.go, or by appending the new ones to a
+// write-ahead log, see wal.go.
+type JournalMode uint32
+
+const (
+	JOURNAL_MODE_DELETE JournalMode = iota
+	JOURNAL_MODE_WAL
+)
+
+var JOURNAL_MODE_NAMES = []string{"delete", "wal"}
+
+/*
+ * Free List Trunk Page Layout. Unused pages are kept in a list of trunk
+ * pages, each holding the page numbers of free leaf pages. The leaf pages
+ * themselves hold nothing.
+ */
+const (
+	FREE_TRUNK_NEXT_OFFSET       = NODE_TYPE_SIZE
+	FREE_TRUNK_NUM_LEAVES_OFFSET = FREE_TRUNK_NEXT_OFFSET + 4
+	FREE_TRUNK_HEADER_SIZE       = FREE_TRUNK_NUM_LEAVES_OFFSET + 4
+	FREE_TRUNK_LEAF_SIZE         = 4
+)
+
+func free_trunk_max_leaves(pageSize uint32) uint32 {
+	return (pageSize - FREE_TRUNK_HEADER_SIZE) / FREE_TRUNK_LEAF_SIZE
+}
+
+// FORMAT_VERSION changes whenever files written by an older version can no
+// longer be read.
+const FORMAT_VERSION = 1
+
+// Page is a page held in the cache. generation is the generation of the
+// pager when the page was last used, dirty is set once the page differs
+// from the file.
+type Page struct {
+	page_num   uint32
+	data       []byte
+	generation uint64
+	dirty      bool
+}
+
+// Pager keeps up to cache_size pages in memory, the least recently used
+// one is written back and dropped when another page is needed.
+//
+// Callers hold on to page data while they work on a row, so a page used in
+// the current generation is never evicted. pager_release starts a new
+// generation once nothing is held any more, until then the cache may grow
+// past cache_size.
+type Pager struct {
+	file_descriptor *os.File
+	file_length     int64
+	page_size       uint32
+	num_pages       uint32
+	cache           map[uint32]*list.Element
+	lru             *list.List // of *Page, most recently used first
+	cache_size      int
+	generation      uint64
+	header          FileHeader
+	// What the header said at the last commit, a rollback goes back to it.
+	committed_header FileHeader
+
+	// The statement journal, see journal.go, which lets a statement inside
+	// a transaction be undone on its own. statement_saved is nil unless
+	// such a statement runs.
+	statement_file      *os.File
+	statement_length    int64
+	statement_saved     map[uint32]bool // pages whose original content is in the statement journal
+	statement_header    FileHeader
+	statement_num_pages uint32
+
+	// The journal of the current transaction, nil until a page is changed.
+	journal_file       *os.File
+	journal_page_count uint32          // pages in the file when the transaction started
+	journaled          map[uint32]bool // pages whose original content is in the journal
+	journal_synced     bool
+
+	// The write-ahead log in WAL mode, nil until the first commit.
+	wal_file               *os.File
+	wal_index              map[uint32]int64 // offset of the latest committed frame of a page
+	wal_pending            map[uint32]int64 // frames of the current transaction
+	wal_length             int64
+	wal_checksum           uint32 // of the last frame
+	wal_committed_length   int64
+	wal_committed_checksum uint32
+}
+
+// FileHeader is what page 0 says about the file. The schema cookie changes
+// with every change to the catalog.
+type FileHeader struct {
+	format_version uint32
+	page_size      uint32
+	page_count     uint32
+	free_list_head uint32 // first trunk page of the free list, 0 when it is empty
+	schema_cookie  uint32
+	free_pages     uint32 // trunk and leaf pages of the free list
+	journal_mode   JournalMode
+}
+
+// read_header checks the header of an existing file against the file.
+func read_header(data []byte, fileLength int64) (FileHeader, error) {
+	if len(data) < HEADER_SIZE || string(data[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE]) != HEADER_MAGIC {
+		return FileHeader{}, errors.New("file is not a database")
+	}
+	header := FileHeader{
+		format_version: binary.LittleEndian.Uint32(data[HEADER_FORMAT_VERSION_OFFSET:]),
+		page_size:      binary.LittleEndian.Uint32(data[HEADER_PAGE_SIZE_OFFSET:]),
+		page_count:     binary.LittleEndian.Uint32(data[HEADER_PAGE_COUNT_OFFSET:]),
+		free_list_head: binary.LittleEndian.Uint32(data[HEADER_FREE_LIST_HEAD_OFFSET:]),
+		schema_cookie:  binary.LittleEndian.Uint32(data[HEADER_SCHEMA_COOKIE_OFFSET:]),
+		free_pages:     binary.LittleEndian.Uint32(data[HEADER_FREE_PAGES_OFFSET:]),
+		journal_mode:   JournalMode(binary.LittleEndian.Uint32(data[HEADER_JOURNAL_MODE_OFFSET:])),
+	}
+	if header.format_version != FORMAT_VERSION {
+		return FileHeader{}, fmt.Errorf("file has format version %d, only version %d is supported", header.format_version, FORMAT_VERSION)
+	}
+	if !is_valid_page_size(header.page_size) {
+		return FileHeader{}, fmt.Errorf("file is corrupt: page size %d is not a power of two from %d to %d", header.page_size, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+	}
+	if int64(header.page_count)*int64(header.page_size) != fileLength {
+		return FileHeader{}, fmt.Errorf("file is corrupt: header says %d pages of %d bytes but the file has %d bytes", header.page_count, header.page_size, fileLength)
+	}
+	if int(header.journal_mode) >= len(JOURNAL_MODE_NAMES) {
+		return FileHeader{}, fmt.Errorf("file is corrupt: unknown journal mode %d", header.journal_mode)
+	}
+	return header, nil
+}
+
+func is_valid_page_size(pageSize uint32) bool {
+	return pageSize >= MIN_PAGE_SIZE && pageSize <= MAX_PAGE_SIZE && pageSize&(pageSize-1) == 0
+}
+
+func write_header(data []byte, header FileHeader) {
+	copy(data[HEADER_MAGIC_OFFSET:], HEADER_MAGIC)
+	binary.LittleEndian.PutUint32(data[HEADER_FORMAT_VERSION_OFFSET:], header.format_version)
+	binary.LittleEndian.PutUint32(data[HEADER_PAGE_SIZE_OFFSET:], header.page_size)
+	binary.LittleEndian.PutUint32(data[HEADER_PAGE_COUNT_OFFSET:], header.page_count)
+	binary.LittleEndian.PutUint32(data[HEADER_FREE_LIST_HEAD_OFFSET:], header.free_list_head)
+	binary.LittleEndian.PutUint32(data[HEADER_SCHEMA_COOKIE_OFFSET:], header.schema_cookie)
+	binary.LittleEndian.PutUint32(data[HEADER_FREE_PAGES_OFFSET:], header.free_pages)
+	binary.LittleEndian.PutUint32(data[HEADER_JOURNAL_MODE_OFFSET:], uint32(header.journal_mode))
+}
+
+func pager_open(filename string, pageSize uint32, cacheSize int) (*Pager, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %s: %v", filename, err)
+	}
+	if err := journal_recover(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	offset, err := f.Seek(0, io.SeekEnd) // Move to end of file, returns new offset
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read file %s: %v", filename, err)
+	}
+	log.Printf("INFO: pager_open: File %s opened, current offset is %d\n", filename, offset)
+
+	pager := &Pager{
+		file_descriptor: f,
+		file_length:     offset,
+		page_size:       pageSize,
+		cache:           make(map[uint32]*list.Element),
+		lru:             list.New(),
+		cache_size:      cacheSize,
+		header:          FileHeader{format_version: FORMAT_VERSION, page_size: pageSize},
+	}
+	walPageCount, err := wal_open(pager)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset > 0 || walPageCount > 0 {
+		// The header and the size of the file are those of the last
+		// commit, which may be in the write-ahead log.
+		fileLength := offset
+		data := make([]byte, min(offset, HEADER_SIZE))
+		if walPageCount > 0 {
+			fileLength = int64(walPageCount) * int64(pager.page_size)
+			data = make([]byte, HEADER_SIZE)
+		}
+		if err := pager_read(pager, HEADER_PAGE_NUM, data); err != nil {
+			pager_close_files(pager)
+			return nil, fmt.Errorf("could not read file %s: %v", filename, err)
+		}
+		if pager.header, err = read_header(data, fileLength); err != nil {
+			pager_close_files(pager)
+			log.Printf("ERROR: pager_open: File %s has no valid header: %v\n", filename, err)
+			return nil, err
+		}
+		if pager.header.page_size != pageSize {
+			log.Printf("WARNING: pager_open: File %s has page size %d, %d only applies to new files\n", filename, pager.header.page_size, pageSize)
+		}
+		pager.page_size = pager.header.page_size
+		pager.num_pages = pager.header.page_count
+	}
+	if pager.wal_file != nil && pager.header.journal_mode != JOURNAL_MODE_WAL {
+		// Left behind when the database was switched out of WAL mode.
+		wal_close(pager)
+	}
+	pager.committed_header = pager.header
+	return pager, nil
+}
+
+// pager_close_files closes the database file and its write-ahead log
+// without writing anything.
+func pager_close_files(pager *Pager) {
+	if pager.wal_file != nil {
+		pager.wal_file.Close()
+	}
+	pager.file_descriptor.Close()
+}
+
+// pager_read fills data from the start of a page: from its latest frame in
+// the write-ahead log if it has one, otherwise from the database file.
+// Pages past the end of the file read as zeroes.
+func pager_read(pager *Pager, pageNum uint32, data []byte) error {
+	if offset, ok := wal_find_frame(pager, pageNum); ok {
+		_, err := pager.wal_file.ReadAt(data, offset+WAL_FRAME_HEADER_SIZE)
+		return err
+	}
+	offset := int64(pageNum) * int64(pager.page_size)
+	if offset >= pager.file_length {
+		return nil
+	}
+	if _, err := pager.file_descriptor.ReadAt(data, offset); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// get_page returns a page from the cache, reading it from the file if it
+// is not there. Pages past the end of the database start out zeroed, even
+// if a statement that was undone left something in the file there.
+func get_page(pager *Pager, pageNum uint32) *Page {
+	if element, ok := pager.cache[pageNum]; ok {
+		pager.lru.MoveToFront(element)
+		page := element.Value.(*Page)
+		page.generation = pager.generation
+		return page
+	}
+
+	page := &Page{page_num: pageNum, data: make([]byte, pager.page_size), generation: pager.generation}
+	if pageNum < pager.num_pages {
+		if err := pager_read(pager, pageNum, page.data); err != nil {
+			log.Fatalf("ERROR: get_page: Could not read page %d from file: %v\n", pageNum, err)
+		}
+	}
+	pager.cache[pageNum] = pager.lru.PushFront(page)
+	if pageNum >= pager.num_pages {
+		pager.num_pages = pageNum + 1
+	}
+	pager_evict(pager)
+	return page
+}
+
+// get_page_for_write returns a page that is about to be changed, so it is
+// journaled and written to the file when it leaves the cache.
+func get_page_for_write(pager *Pager, pageNum uint32) *Page {
+	page := get_page(pager, pageNum)
+	if pager.statement_saved != nil && !pager.statement_saved[pageNum] && pageNum < pager.statement_num_pages {
+		statement_journal_page(pager, page)
+	}
+	if pager.header.journal_mode != JOURNAL_MODE_WAL {
+		journal_page(pager, page)
+	}
+	page.dirty = true
+	return page
+}
+
+// pager_evict writes back and drops the least recently used pages while
+// the cache holds more than cache_size pages and some are not in use.
+func pager_evict(pager *Pager) {
+	for len(pager.cache) > pager.cache_size {
+		element := pager.lru.Back()
+		page := element.Value.(*Page)
+		if page.generation == pager.generation {
+			// Every page from here on is in use.
+			return
+		}
+		pager_flush(pager, page)
+		pager.lru.Remove(element)
+		delete(pager.cache, page.page_num)
+		log.Printf("INFO: pager_evict: Evicted page %d\n", page.page_num)
+	}
+}
+
+// pager_release tells the pager that no page data is held any more, so
+// every page in the cache may be evicted.
+func pager_release(pager *Pager) {
+	pager.generation++
+	pager_evict(pager)
+}
+
+// get_unused_page_num hands out a page from the free list if there is one,
+// otherwise the next page number past the end of the file. A page from the
+// free list is cleared so it reads like a new one.
+func get_unused_page_num(pager *Pager) uint32 {
+	trunkPageNum := pager.header.free_list_head
+	if trunkPageNum == 0 {
+		return pager.num_pages
+	}
+	trunk := get_page_for_write(pager, trunkPageNum).data
+	numLeaves := binary.LittleEndian.Uint32(trunk[FREE_TRUNK_NUM_LEAVES_OFFSET:])
+	pageNum := trunkPageNum
+	if numLeaves > 0 {
+		pageNum = binary.LittleEndian.Uint32(trunk[FREE_TRUNK_HEADER_SIZE+(numLeaves-1)*FREE_TRUNK_LEAF_SIZE:])
+		binary.LittleEndian.PutUint32(trunk[FREE_TRUNK_NUM_LEAVES_OFFSET:], numLeaves-1)
+	} else {
+		// The trunk has no leaves left, so it is handed out itself.
+		pager.header.free_list_head = binary.LittleEndian.Uint32(trunk[FREE_TRUNK_NEXT_OFFSET:])
+	}
+	pager.header.free_pages--
+	clear(get_page_for_write(pager, pageNum).data)
+	return pageNum
+}
+
+// free_page puts a page on the free list, as a leaf of the first trunk if
+// it has room, otherwise as the new first trunk.
+func free_page(pager *Pager, pageNum uint32) {
+	pager.header.free_pages++
+	if trunkPageNum := pager.header.free_list_head; trunkPageNum != 0 {
+		trunk := get_page_for_write(pager, trunkPageNum).data
+		numLeaves := binary.LittleEndian.Uint32(trunk[FREE_TRUNK_NUM_LEAVES_OFFSET:])
+		if numLeaves < free_trunk_max_leaves(pager.page_size) {
+			binary.LittleEndian.PutUint32(trunk[FREE_TRUNK_HEADER_SIZE+numLeaves*FREE_TRUNK_LEAF_SIZE:], pageNum)
+			binary.LittleEndian.PutUint32(trunk[FREE_TRUNK_NUM_LEAVES_OFFSET:], numLeaves+1)
+			return
+		}
+	}
+	trunk := get_page_for_write(pager, pageNum).data
+	clear(trunk)
+	set_node_type(trunk, NODE_FREE)
+	binary.LittleEndian.PutUint32(trunk[FREE_TRUNK_NEXT_OFFSET:], pager.header.free_list_head)
+	pager.header.free_list_head = pageNum
+}
+
+// pager_flush writes a page to the file if it is dirty.
+func pager_flush(pager *Pager, page *Page) {
+	if !page.dirty {
+		return
+	}
+	if pager.header.journal_mode == JOURNAL_MODE_WAL {
+		wal_append(pager, page, 0)
+		page.dirty = false
+		return
+	}
+	journal_sync(pager)
+	offset := int64(page.page_num) * int64(pager.page_size)
+	_, err := pager.file_descriptor.WriteAt(page.data, offset)
+	if err != nil {
+		log.Fatalf("ERROR: pager_flush: Could not write page %d to file: %v\n", page.page_num, err)
+	}
+	pager.file_length = max(pager.file_length, offset+int64(pager.page_size))
+	page.dirty = false
+	log.Printf("INFO: pager_flush: Wrote page %d\n", page.page_num)
+}
+
+// pager_flush_all writes every dirty page in the cache to the file.
+func pager_flush_all(pager *Pager) {
+	for element := pager.lru.Front(); element != nil; element = element.Next() {
+		pager_flush(pager, element.Value.(*Page))
+	}
+}
+
+// pager_commit writes the changes made since the last commit, the header
+// only if it changed. In WAL mode they are appended to the log, otherwise
+// they go to the database file and the journal is deleted once they are on
+// disk.
+func pager_commit(pager *Pager) {
+	statement_journal_close(pager)
+	pager.header.page_count = pager.num_pages
+	pager.committed_header = pager.header
+	header := make([]byte, HEADER_SIZE)
+	write_header(header, pager.header)
+	if !bytes.Equal(get_page(pager, HEADER_PAGE_NUM).data[:HEADER_SIZE], header) {
+		copy(get_page_for_write(pager, HEADER_PAGE_NUM).data, header)
+	}
+	if pager.header.journal_mode == JOURNAL_MODE_WAL {
+		wal_commit(pager)
+		return
+	}
+	if pager.journal_file == nil {
+		return
+	}
+	pager_flush_all(pager)
+	// Pages that were never written still count, as zeroes. Pages written
+	// by a statement that was undone are cut off.
+	if fileLength := int64(pager.num_pages) * int64(pager.page_size); pager.file_length != fileLength {
+		if err := pager.file_descriptor.Truncate(fileLength); err != nil {
+			log.Fatalf("ERROR: pager_commit: Could not resize database file: %v\n", err)
+		}
+		pager.file_length = fileLength
+	}
+	if err := pager.file_descriptor.Sync(); err != nil {
+		log.Fatalf("ERROR: pager_commit: Could not sync database file: %v\n", err)
+	}
+	journal_end(pager)
+}
+
+// pager_rollback undoes every change since the last commit. The pages the
+// transaction wrote are put back from the journal, in WAL mode its frames
+// are dropped, and the cache is emptied as it may hold changed pages.
+func pager_rollback(pager *Pager) {
+	if pager.header.journal_mode == JOURNAL_MODE_WAL {
+		clear(pager.wal_pending)
+		pager.wal_length = pager.wal_committed_length
+		pager.wal_checksum = pager.wal_committed_checksum
+	} else if pager.journal_file != nil {
+		journal_rollback(pager)
+	}
+	clear(pager.cache)
+	pager.lru.Init()
+	pager.header = pager.committed_header
+	pager.num_pages = pager.header.page_count
+	statement_journal_close(pager)
+	log.Printf("INFO: pager_rollback: Rolled back to %d pages\n", pager.num_pages)
+}
+
+// pager_begin_statement starts saving every page the next statement changes
+// in the statement journal, so the statement can be undone without undoing
+// the rest of the transaction.
+func pager_begin_statement(pager *Pager) {
+	pager.statement_saved = make(map[uint32]bool)
+	pager.statement_length = 0
+	pager.statement_header = pager.header
+	pager.statement_num_pages = pager.num_pages
+}
+
+// pager_end_statement forgets the saved pages of a statement that went
+// through, the next statement reuses the statement journal.
+func pager_end_statement(pager *Pager) {
+	pager.statement_saved = nil
+	pager.statement_length = 0
+}
+
+// pager_rollback_statement undoes the current statement: the saved pages go
+// back into the cache as changes of the transaction, and the pages the
+// statement added are dropped.
+func pager_rollback_statement(pager *Pager) {
+	pager.statement_saved = nil
+	numRestored := statement_journal_rollback(pager)
+	for element := pager.lru.Front(); element != nil; {
+		next := element.Next()
+		if page := element.Value.(*Page); page.page_num >= pager.statement_num_pages {
+			pager.lru.Remove(element)
+			delete(pager.cache, page.page_num)
+		}
+		element = next
+	}
+	for pageNum := range pager.wal_pending {
+		if pageNum >= pager.statement_num_pages {
+			delete(pager.wal_pending, pageNum)
+		}
+	}
+	pager.header = pager.statement_header
+	pager.num_pages = pager.statement_num_pages
+	log.Printf("INFO: pager_rollback_statement: Restored %d pages\n", numRestored)
+}
@@ -0,0 +1,893 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type ExprType int
+
+const (
+	EXPR_INTEGER ExprType = iota
+	EXPR_REAL
+	EXPR_STRING
+	EXPR_BLOB
+	EXPR_COLUMN
+	EXPR_NULL
+	EXPR_BINARY
+	EXPR_UNARY
+	EXPR_BETWEEN
+	EXPR_IN
+	EXPR_IS_NULL
+	EXPR_FUNCTION
+	EXPR_AGGREGATE
+)
+
+// Expr is a node of an expression tree. Which fields are used depends on et.
+type Expr struct {
+	et      ExprType
+	pos     int
+	integer int64   // EXPR_INTEGER
+	real    float64 // EXPR_REAL
+	text    string  // EXPR_STRING value, EXPR_BLOB bytes, EXPR_COLUMN name, EXPR_FUNCTION and EXPR_AGGREGATE name in lower case
+	column  int     // EXPR_COLUMN and EXPR_AGGREGATE index into the row, set by resolve_expr and collect_aggregates
+	op      string  // EXPR_BINARY and EXPR_UNARY operator, e.g. "=", "LIKE", "||" or "NOT"
+	left    *Expr   // operand of EXPR_UNARY, EXPR_BETWEEN, EXPR_IN and EXPR_IS_NULL
+	right   *Expr   // EXPR_BINARY right operand
+	args    []*Expr // EXPR_BETWEEN lower and upper bound, EXPR_IN list, EXPR_FUNCTION and EXPR_AGGREGATE arguments
+}
+
+// ResultColumn is one entry of the SELECT list. name is what the output
+// header shows: the alias if there is one, otherwise the expression text.
+type ResultColumn struct {
+	expr *Expr
+	name string
+}
+
+// OrderTerm is one expression of ORDER BY.
+type OrderTerm struct {
+	expr       *Expr
+	descending bool
+}
+
+// ColumnDefinition is a column of CREATE TABLE as written, size is 0 when
+// the type has no length.
+type ColumnDefinition struct {
+	name          string
+	pos           int
+	type_name     string
+	size          int64
+	primary_key   bool
+	not_null      bool
+	default_value *Expr // nil without DEFAULT
+}
+
+type AlterAction int
+
+const (
+	ALTER_RENAME_TABLE AlterAction = iota
+	ALTER_RENAME_COLUMN
+	ALTER_ADD_COLUMN
+)
+
+type Assignment struct {
+	column string
+	pos    int
+	value  *Expr
+}
+
+// Parser is a recursive descent parser with one token of lookahead. Parse
+// functions report errors by panicking with a *SyntaxError, which
+// parse_statement recovers and returns.
+type Parser struct {
+	lexer *Lexer
+	token Token
+}
+
+func parser_fail(pos int, format string, args ...any) {
+	panic(&SyntaxError{pos, fmt.Sprintf(format, args...)})
+}
+
+// parser_advance consumes the current token and returns it.
+func parser_advance(parser *Parser) Token {
+	token := parser.token
+	next, err := next_token(parser.lexer)
+	if err != nil {
+		panic(err)
+	}
+	parser.token = next
+	return token
+}
+
+func parser_at_keyword(parser *Parser, keyword string) bool {
+	return parser.token.tt == TOKEN_KEYWORD && parser.token.text == keyword
+}
+
+func parser_accept_keyword(parser *Parser, keyword string) bool {
+	if parser_at_keyword(parser, keyword) {
+		parser_advance(parser)
+		return true
+	}
+	return false
+}
+
+func parser_expect_keyword(parser *Parser, keyword string) Token {
+	if !parser_at_keyword(parser, keyword) {
+		parser_fail(parser.token.pos, "expected %s but found %s", keyword, token_description(parser.token))
+	}
+	return parser_advance(parser)
+}
+
+func parser_accept(parser *Parser, tt TokenType) bool {
+	if parser.token.tt == tt {
+		parser_advance(parser)
+		return true
+	}
+	return false
+}
+
+func parser_expect(parser *Parser, tt TokenType, what string) Token {
+	if parser.token.tt != tt {
+		parser_fail(parser.token.pos, "expected %s but found %s", what, token_description(parser.token))
+	}
+	return parser_advance(parser)
+}
+
+func parse_identifier(parser *Parser, what string) Token {
+	return parser_expect(parser, TOKEN_IDENTIFIER, what)
+}
+
+// parse_statement fills statement from input. ok is false if input does
+// not start with a statement keyword at all.
+func parse_statement(input string, statement *Statement) (ok bool, err *SyntaxError) {
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxError, isSyntaxError := r.(*SyntaxError)
+			if !isSyntaxError {
+				panic(r)
+			}
+			ok = true
+			err = syntaxError
+		}
+	}()
+
+	parser := &Parser{lexer: &Lexer{input: input}}
+	parser_advance(parser)
+	switch {
+	case parser_at_keyword(parser, "INSERT"):
+		parse_insert(parser, statement)
+	case parser_at_keyword(parser, "SELECT"):
+		parse_select(parser, statement)
+	case parser_at_keyword(parser, "UPDATE"):
+		parse_update(parser, statement)
+	case parser_at_keyword(parser, "DELETE"):
+		parse_delete(parser, statement)
+	case parser_at_keyword(parser, "CREATE"):
+		parse_create_table(parser, statement)
+	case parser_at_keyword(parser, "DROP"):
+		parse_drop_table(parser, statement)
+	case parser_at_keyword(parser, "ALTER"):
+		parse_alter_table(parser, statement)
+	case parser_accept_keyword(parser, "VACUUM"):
+		statement.st = STATEMENT_VACUUM
+	case parser_at_keyword(parser, "PRAGMA"):
+		parse_pragma(parser, statement)
+	case parser_accept_keyword(parser, "BEGIN"):
+		statement.st = STATEMENT_BEGIN
+		parser_accept_keyword(parser, "TRANSACTION")
+	case parser_accept_keyword(parser, "COMMIT"):
+		statement.st = STATEMENT_COMMIT
+		parser_accept_keyword(parser, "TRANSACTION")
+	case parser_accept_keyword(parser, "ROLLBACK"):
+		statement.st = STATEMENT_ROLLBACK
+		parser_accept_keyword(parser, "TRANSACTION")
+	default:
+		return false, nil
+	}
+
+	parser_accept(parser, TOKEN_SEMICOLON)
+	if parser.token.tt != TOKEN_EOF {
+		parser_fail(parser.token.pos, "unexpected %s after end of statement", token_description(parser.token))
+	}
+	return true, nil
+}
+
+// parse_create_table handles
+//
+//	CREATE TABLE <table> (<column definition>, ...)
+func parse_create_table(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_CREATE_TABLE
+	parser_expect_keyword(parser, "CREATE")
+	parser_expect_keyword(parser, "TABLE")
+	table := parse_identifier(parser, "table name")
+	statement.table_name = table.text
+	statement.table_pos = table.pos
+
+	parser_expect(parser, TOKEN_LPAREN, "\"(\"")
+	for {
+		statement.column_definitions = append(statement.column_definitions, parse_column_definition(parser))
+		if !parser_accept(parser, TOKEN_COMMA) {
+			break
+		}
+	}
+	parser_expect(parser, TOKEN_RPAREN, "\")\"")
+}
+
+// parse_column_definition handles
+//
+//	<column> <type>[(<length>)] [PRIMARY KEY] [NOT NULL] [DEFAULT <value>]
+func parse_column_definition(parser *Parser) ColumnDefinition {
+	column := parse_identifier(parser, "column name")
+	definition := ColumnDefinition{
+		name:      column.text,
+		pos:       column.pos,
+		type_name: parse_identifier(parser, "column type").text,
+	}
+	if parser_accept(parser, TOKEN_LPAREN) {
+		size := parser_expect(parser, TOKEN_NUMBER, "length")
+		definition.size = parse_integer(size, false).integer
+		if definition.size <= 0 {
+			parser_fail(size.pos, "length must be positive")
+		}
+		parser_expect(parser, TOKEN_RPAREN, "\")\"")
+	}
+	for {
+		if parser_accept_keyword(parser, "PRIMARY") {
+			parser_expect_keyword(parser, "KEY")
+			definition.primary_key = true
+		} else if parser_accept_keyword(parser, "NOT") {
+			parser_expect_keyword(parser, "NULL")
+			definition.not_null = true
+		} else if parser_accept_keyword(parser, "DEFAULT") {
+			// A literal, a signed number or an expression in parentheses.
+			definition.default_value = parse_unary(parser)
+		} else {
+			break
+		}
+	}
+	return definition
+}
+
+// parse_drop_table handles
+//
+//	DROP TABLE [IF EXISTS] <table>
+func parse_drop_table(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_DROP_TABLE
+	parser_expect_keyword(parser, "DROP")
+	parser_expect_keyword(parser, "TABLE")
+	if parser_accept_keyword(parser, "IF") {
+		parser_expect_keyword(parser, "EXISTS")
+		statement.if_exists = true
+	}
+	table := parse_identifier(parser, "table name")
+	statement.table_name = table.text
+	statement.table_pos = table.pos
+}
+
+// parse_pragma handles
+//
+//	PRAGMA <name> [= <value>]
+func parse_pragma(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_PRAGMA
+	parser_expect_keyword(parser, "PRAGMA")
+	name := parse_identifier(parser, "pragma name")
+	statement.pragma_name = strings.ToLower(name.text)
+	statement.pragma_pos = name.pos
+	if parser_accept(parser, TOKEN_EQ) {
+		value := parser.token
+		if value.tt != TOKEN_IDENTIFIER && value.tt != TOKEN_KEYWORD && value.tt != TOKEN_STRING {
+			parser_fail(value.pos, "expected pragma value but found %s", token_description(value))
+		}
+		parser_advance(parser)
+		statement.pragma_value = strings.ToLower(value.text)
+		statement.pragma_value_pos = value.pos
+	}
+}
+
+// parse_alter_table handles
+//
+//	ALTER TABLE <table> RENAME TO <new table>
+//	ALTER TABLE <table> RENAME [COLUMN] <column> TO <new column>
+//	ALTER TABLE <table> ADD [COLUMN] <column definition>
+func parse_alter_table(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_ALTER_TABLE
+	parser_expect_keyword(parser, "ALTER")
+	parser_expect_keyword(parser, "TABLE")
+	table := parse_identifier(parser, "table name")
+	statement.table_name = table.text
+	statement.table_pos = table.pos
+
+	if parser_accept_keyword(parser, "ADD") {
+		parser_accept_keyword(parser, "COLUMN")
+		statement.alter_action = ALTER_ADD_COLUMN
+		statement.column_definitions = []ColumnDefinition{parse_column_definition(parser)}
+		return
+	}
+	parser_expect_keyword(parser, "RENAME")
+	if parser_accept_keyword(parser, "TO") {
+		statement.alter_action = ALTER_RENAME_TABLE
+	} else {
+		parser_accept_keyword(parser, "COLUMN")
+		column := parse_identifier(parser, "column name")
+		statement.alter_action = ALTER_RENAME_COLUMN
+		statement.column_name = column.text
+		statement.column_pos = column.pos
+		parser_expect_keyword(parser, "TO")
+	}
+	name := parse_identifier(parser, "new name")
+	statement.new_name = name.text
+	statement.new_name_pos = name.pos
+}
+
+// parse_insert handles
+//
+//	INSERT INTO <table> [(<column>, ...)] VALUES (<expr>, ...) [, (...)]
+//
+// as well as the shorthand "insert <id> <username> <email>".
+func parse_insert(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_INSERT
+	parser_expect_keyword(parser, "INSERT")
+	if !parser_at_keyword(parser, "INTO") {
+		parse_shorthand_insert(parser, statement)
+		return
+	}
+	parser_advance(parser)
+
+	table := parse_identifier(parser, "table name")
+	statement.table_name = table.text
+	statement.table_pos = table.pos
+
+	if parser_accept(parser, TOKEN_LPAREN) {
+		for {
+			column := parse_identifier(parser, "column name")
+			statement.columns = append(statement.columns, column.text)
+			if !parser_accept(parser, TOKEN_COMMA) {
+				break
+			}
+		}
+		parser_expect(parser, TOKEN_RPAREN, "\")\"")
+	}
+
+	parser_expect_keyword(parser, "VALUES")
+	for {
+		parser_expect(parser, TOKEN_LPAREN, "\"(\"")
+		var values []*Expr
+		for {
+			values = append(values, parse_expression(parser))
+			if !parser_accept(parser, TOKEN_COMMA) {
+				break
+			}
+		}
+		parser_expect(parser, TOKEN_RPAREN, "\")\"")
+		statement.values = append(statement.values, values)
+		if !parser_accept(parser, TOKEN_COMMA) {
+			break
+		}
+	}
+}
+
+// parse_shorthand_insert reads "<id> <username> <email>" as whitespace
+// separated words rather than tokens, so values such as user#1 or
+// a@b.com need no quoting.
+func parse_shorthand_insert(parser *Parser, statement *Statement) {
+	statement.shorthand_insert = true
+	statement.table_name = "users"
+	statement.table_pos = parser.token.pos
+
+	input := parser.lexer.input
+	pos := parser.token.pos
+	var values []*Expr
+	for pos < len(input) {
+		for pos < len(input) && (input[pos] == ' ' || input[pos] == '\t') {
+			pos += 1
+		}
+		if pos >= len(input) {
+			break
+		}
+		end := pos
+		for end < len(input) && input[end] != ' ' && input[end] != '\t' {
+			end += 1
+		}
+		word := input[pos:end]
+		if len(values) == 0 {
+			id, err := strconv.ParseInt(word, 10, 64)
+			if err != nil {
+				parser_fail(pos, "id %s is not numeric", word)
+			}
+			values = append(values, &Expr{et: EXPR_INTEGER, pos: pos, integer: id})
+		} else {
+			values = append(values, &Expr{et: EXPR_STRING, pos: pos, text: word})
+		}
+		pos = end
+	}
+	if len(values) != 3 {
+		parser_fail(pos, "expected insert <id> <username> <email>")
+	}
+	statement.values = [][]*Expr{values}
+
+	// Everything has been read, leave the lexer at the end of the input.
+	parser.lexer.pos = len(input)
+	parser.token = Token{tt: TOKEN_EOF, pos: len(input)}
+}
+
+// parse_select handles
+//
+//	SELECT * | <expr> [AS <alias>], ... [FROM <table> [WHERE <expr>]]
+//
+// and the shorthands "select", "select desc" and "select from <id>".
+func parse_select(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_SELECT
+	statement.table_name = "users"
+	selectToken := parser_expect_keyword(parser, "SELECT")
+	statement.table_pos = selectToken.pos
+
+	switch {
+	case parser.token.tt == TOKEN_EOF || parser.token.tt == TOKEN_SEMICOLON:
+		return
+	case parser_accept_keyword(parser, "DESC"):
+		statement.reverse = true
+		return
+	case parser_at_keyword(parser, "FROM"):
+		parser_advance(parser)
+		start := parse_primary(parser)
+		statement.where = &Expr{
+			et:    EXPR_BINARY,
+			pos:   start.pos,
+			op:    ">=",
+			left:  &Expr{et: EXPR_COLUMN, pos: start.pos, text: "id"},
+			right: start,
+		}
+		return
+	}
+
+	if !parser_accept(parser, TOKEN_STAR) {
+		for {
+			statement.result_columns = append(statement.result_columns, parse_result_column(parser))
+			if !parser_accept(parser, TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+
+	if parser_accept_keyword(parser, "FROM") {
+		table := parse_identifier(parser, "table name")
+		statement.table_name = table.text
+		statement.table_pos = table.pos
+		if parser_accept_keyword(parser, "WHERE") {
+			statement.where = parse_expression(parser)
+		}
+		if parser_accept_keyword(parser, "GROUP") {
+			parser_expect_keyword(parser, "BY")
+			for {
+				statement.group_by = append(statement.group_by, parse_expression(parser))
+				if !parser_accept(parser, TOKEN_COMMA) {
+					break
+				}
+			}
+		}
+		if parser_accept_keyword(parser, "HAVING") {
+			statement.having = parse_expression(parser)
+		}
+	} else {
+		// SELECT <expr>, ... without a table is evaluated once.
+		if len(statement.result_columns) == 0 {
+			parser_fail(parser.token.pos, "expected FROM but found %s", token_description(parser.token))
+		}
+		statement.table_name = ""
+	}
+
+	if parser_accept_keyword(parser, "ORDER") {
+		parser_expect_keyword(parser, "BY")
+		for {
+			term := OrderTerm{expr: parse_expression(parser)}
+			if parser_accept_keyword(parser, "DESC") {
+				term.descending = true
+			} else {
+				parser_accept_keyword(parser, "ASC")
+			}
+			statement.order_by = append(statement.order_by, term)
+			if !parser_accept(parser, TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	if parser_accept_keyword(parser, "LIMIT") {
+		statement.limit = parse_expression(parser)
+		if parser_accept_keyword(parser, "OFFSET") {
+			statement.offset = parse_expression(parser)
+		} else if parser_accept(parser, TOKEN_COMMA) {
+			// LIMIT <offset>, <count>
+			statement.offset = statement.limit
+			statement.limit = parse_expression(parser)
+		}
+	}
+}
+
+func parse_result_column(parser *Parser) ResultColumn {
+	start := parser.token.pos
+	expr := parse_expression(parser)
+	name := strings.TrimSpace(parser.lexer.input[start:parser.token.pos])
+	if expr.et == EXPR_COLUMN {
+		name = expr.text
+	}
+	if parser_accept_keyword(parser, "AS") {
+		name = parser_expect(parser, TOKEN_IDENTIFIER, "alias").text
+	} else if parser.token.tt == TOKEN_IDENTIFIER {
+		name = parser_advance(parser).text
+	}
+	return ResultColumn{expr: expr, name: name}
+}
+
+// parse_update handles
+//
+//	UPDATE <table> SET <column> = <expr> [, ...] [WHERE <expr>]
+//	UPDATE <id> SET <column> = <expr> [, ...]
+func parse_update(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_UPDATE
+	statement.table_name = "users"
+	parser_expect_keyword(parser, "UPDATE")
+
+	var id *Expr
+	if parser.token.tt == TOKEN_NUMBER {
+		id = parse_primary(parser)
+		statement.table_pos = id.pos
+	} else {
+		table := parse_identifier(parser, "table name or id")
+		statement.table_name = table.text
+		statement.table_pos = table.pos
+	}
+
+	parser_expect_keyword(parser, "SET")
+	if id != nil {
+		parse_shorthand_assignments(parser, statement)
+	}
+	for id == nil {
+		column := parse_identifier(parser, "column name")
+		parser_expect(parser, TOKEN_EQ, "\"=\"")
+		statement.assignments = append(statement.assignments, Assignment{
+			column: column.text,
+			pos:    column.pos,
+			value:  parse_expression(parser),
+		})
+		if !parser_accept(parser, TOKEN_COMMA) {
+			break
+		}
+	}
+
+	if id != nil {
+		statement.where = &Expr{
+			et:    EXPR_BINARY,
+			pos:   id.pos,
+			op:    "=",
+			left:  &Expr{et: EXPR_COLUMN, pos: id.pos, text: "id"},
+			right: id,
+		}
+	} else if parser_accept_keyword(parser, "WHERE") {
+		statement.where = parse_expression(parser)
+	}
+}
+
+// parse_shorthand_assignments reads "<column>=<value>, ..." of the update
+// shorthand with the values as text up to the next comma, like the insert
+// shorthand, so a@b.com needs no quoting. A quoted value is read as a
+// string.
+func parse_shorthand_assignments(parser *Parser, statement *Statement) {
+	input := parser.lexer.input
+	pos := parser.token.pos
+	for {
+		for pos < len(input) && (input[pos] == ' ' || input[pos] == '\t') {
+			pos += 1
+		}
+		columnPos := pos
+		for pos < len(input) && input[pos] != '=' && input[pos] != ',' {
+			pos += 1
+		}
+		column := strings.TrimSpace(input[columnPos:pos])
+		if column == "" {
+			parser_fail(columnPos, "expected column name")
+		}
+		if pos >= len(input) || input[pos] != '=' {
+			parser_fail(pos, "expected \"=\" after %s", column)
+		}
+		pos += 1
+		for pos < len(input) && (input[pos] == ' ' || input[pos] == '\t') {
+			pos += 1
+		}
+
+		value := &Expr{et: EXPR_STRING, pos: pos}
+		if pos < len(input) && input[pos] == '\'' {
+			lexer := &Lexer{input: input, pos: pos}
+			token, err := next_token(lexer)
+			if err != nil {
+				panic(err)
+			}
+			value.text = token.text
+			pos = lexer.pos
+		} else {
+			end := pos
+			for end < len(input) && input[end] != ',' {
+				end += 1
+			}
+			value.text = strings.TrimSpace(input[pos:end])
+			pos = end
+		}
+		statement.assignments = append(statement.assignments, Assignment{column: column, pos: columnPos, value: value})
+
+		for pos < len(input) && (input[pos] == ' ' || input[pos] == '\t') {
+			pos += 1
+		}
+		if pos >= len(input) {
+			break
+		}
+		if input[pos] != ',' {
+			parser_fail(pos, "expected \",\" between assignments")
+		}
+		pos += 1
+	}
+
+	// Everything has been read, leave the lexer at the end of the input.
+	parser.lexer.pos = len(input)
+	parser.token = Token{tt: TOKEN_EOF, pos: len(input)}
+}
+
+// parse_delete handles
+//
+//	DELETE [FROM <table>] [WHERE <expr>]
+func parse_delete(parser *Parser, statement *Statement) {
+	statement.st = STATEMENT_DELETE
+	statement.table_name = "users"
+	deleteToken := parser_expect_keyword(parser, "DELETE")
+	statement.table_pos = deleteToken.pos
+
+	if parser_accept_keyword(parser, "FROM") {
+		table := parse_identifier(parser, "table name")
+		statement.table_name = table.text
+		statement.table_pos = table.pos
+	}
+	if parser_accept_keyword(parser, "WHERE") {
+		statement.where = parse_expression(parser)
+	}
+}
+
+// Operator precedence, loosest first: OR, AND, NOT, the comparisons
+// =, !=, <, <=, >, >=, LIKE, IN, BETWEEN and IS NULL, then + and -,
+// then *, / and %, then ||, and finally unary - and +.
+func parse_expression(parser *Parser) *Expr {
+	return parse_or(parser)
+}
+
+func parse_or(parser *Parser) *Expr {
+	left := parse_and(parser)
+	for parser_at_keyword(parser, "OR") {
+		op := parser_advance(parser)
+		left = &Expr{et: EXPR_BINARY, pos: op.pos, op: "OR", left: left, right: parse_and(parser)}
+	}
+	return left
+}
+
+func parse_and(parser *Parser) *Expr {
+	left := parse_not(parser)
+	for parser_at_keyword(parser, "AND") {
+		op := parser_advance(parser)
+		left = &Expr{et: EXPR_BINARY, pos: op.pos, op: "AND", left: left, right: parse_not(parser)}
+	}
+	return left
+}
+
+func parse_not(parser *Parser) *Expr {
+	if parser_at_keyword(parser, "NOT") {
+		op := parser_advance(parser)
+		return &Expr{et: EXPR_UNARY, pos: op.pos, op: "NOT", left: parse_not(parser)}
+	}
+	return parse_comparison(parser)
+}
+
+func parse_comparison(parser *Parser) *Expr {
+	left := parse_additive(parser)
+	switch parser.token.tt {
+	case TOKEN_EQ, TOKEN_NE, TOKEN_LT, TOKEN_LE, TOKEN_GT, TOKEN_GE:
+		op := parser_advance(parser)
+		return &Expr{et: EXPR_BINARY, pos: op.pos, op: comparison_operator(op), left: left, right: parse_additive(parser)}
+	}
+
+	if parser_at_keyword(parser, "IS") {
+		is := parser_advance(parser)
+		negated := parser_accept_keyword(parser, "NOT")
+		parser_expect_keyword(parser, "NULL")
+		expr := &Expr{et: EXPR_IS_NULL, pos: is.pos, left: left}
+		if negated {
+			expr = &Expr{et: EXPR_UNARY, pos: is.pos, op: "NOT", left: expr}
+		}
+		return expr
+	}
+
+	// x NOT LIKE y, x NOT IN (...) and x NOT BETWEEN y AND z are parsed
+	// as NOT applied to the positive form.
+	negated := false
+	notPos := parser.token.pos
+	if parser_accept_keyword(parser, "NOT") {
+		negated = true
+	}
+	var expr *Expr
+	switch {
+	case parser_at_keyword(parser, "LIKE"):
+		like := parser_advance(parser)
+		expr = &Expr{et: EXPR_BINARY, pos: like.pos, op: "LIKE", left: left, right: parse_additive(parser)}
+	case parser_at_keyword(parser, "BETWEEN"):
+		between := parser_advance(parser)
+		lower := parse_additive(parser)
+		parser_expect_keyword(parser, "AND")
+		upper := parse_additive(parser)
+		expr = &Expr{et: EXPR_BETWEEN, pos: between.pos, left: left, args: []*Expr{lower, upper}}
+	case parser_at_keyword(parser, "IN"):
+		in := parser_advance(parser)
+		parser_expect(parser, TOKEN_LPAREN, "\"(\"")
+		var list []*Expr
+		for {
+			list = append(list, parse_additive(parser))
+			if !parser_accept(parser, TOKEN_COMMA) {
+				break
+			}
+		}
+		parser_expect(parser, TOKEN_RPAREN, "\")\"")
+		expr = &Expr{et: EXPR_IN, pos: in.pos, left: left, args: list}
+	default:
+		if negated {
+			parser_fail(parser.token.pos, "expected LIKE, IN or BETWEEN after NOT but found %s", token_description(parser.token))
+		}
+		return left
+	}
+	if negated {
+		expr = &Expr{et: EXPR_UNARY, pos: notPos, op: "NOT", left: expr}
+	}
+	return expr
+}
+
+// comparison_operator maps the spellings "==" and "<>" onto "=" and "!=".
+func comparison_operator(token Token) string {
+	switch token.tt {
+	case TOKEN_EQ:
+		return "="
+	case TOKEN_NE:
+		return "!="
+	}
+	return token.text
+}
+
+func parse_additive(parser *Parser) *Expr {
+	left := parse_multiplicative(parser)
+	for parser.token.tt == TOKEN_PLUS || parser.token.tt == TOKEN_MINUS {
+		op := parser_advance(parser)
+		left = &Expr{et: EXPR_BINARY, pos: op.pos, op: op.text, left: left, right: parse_multiplicative(parser)}
+	}
+	return left
+}
+
+func parse_multiplicative(parser *Parser) *Expr {
+	left := parse_concat(parser)
+	for parser.token.tt == TOKEN_STAR || parser.token.tt == TOKEN_SLASH || parser.token.tt == TOKEN_PERCENT {
+		op := parser_advance(parser)
+		left = &Expr{et: EXPR_BINARY, pos: op.pos, op: op.text, left: left, right: parse_concat(parser)}
+	}
+	return left
+}
+
+func parse_concat(parser *Parser) *Expr {
+	left := parse_unary(parser)
+	for parser.token.tt == TOKEN_CONCAT {
+		op := parser_advance(parser)
+		left = &Expr{et: EXPR_BINARY, pos: op.pos, op: "||", left: left, right: parse_unary(parser)}
+	}
+	return left
+}
+
+func parse_unary(parser *Parser) *Expr {
+	token := parser.token
+	switch token.tt {
+	case TOKEN_MINUS:
+		parser_advance(parser)
+		if parser.token.tt == TOKEN_NUMBER {
+			// Fold -5 into a literal so a negative key can narrow a scan.
+			number := parser_advance(parser)
+			expr := parse_number(number, true)
+			expr.pos = token.pos
+			return expr
+		}
+		return &Expr{et: EXPR_UNARY, pos: token.pos, op: "-", left: parse_unary(parser)}
+	case TOKEN_PLUS:
+		parser_advance(parser)
+		return parse_unary(parser)
+	}
+	return parse_primary(parser)
+}
+
+func parse_primary(parser *Parser) *Expr {
+	token := parser.token
+	switch token.tt {
+	case TOKEN_NUMBER:
+		parser_advance(parser)
+		return parse_number(token, false)
+	case TOKEN_STRING:
+		parser_advance(parser)
+		return &Expr{et: EXPR_STRING, pos: token.pos, text: token.text}
+	case TOKEN_BLOB:
+		parser_advance(parser)
+		return &Expr{et: EXPR_BLOB, pos: token.pos, text: token.text}
+	case TOKEN_KEYWORD:
+		if token.text == "NULL" {
+			parser_advance(parser)
+			return &Expr{et: EXPR_NULL, pos: token.pos}
+		}
+	case TOKEN_IDENTIFIER:
+		parser_advance(parser)
+		if parser_accept(parser, TOKEN_LPAREN) {
+			return parse_function_call(parser, token)
+		}
+		return &Expr{et: EXPR_COLUMN, pos: token.pos, text: token.text}
+	case TOKEN_LPAREN:
+		parser_advance(parser)
+		expr := parse_expression(parser)
+		parser_expect(parser, TOKEN_RPAREN, "\")\"")
+		return expr
+	}
+	parser_fail(token.pos, "expected a value but found %s", token_description(token))
+	return nil
+}
+
+// parse_function_call reads the argument list after "<name>(".
+func parse_function_call(parser *Parser, name Token) *Expr {
+	expr := &Expr{et: EXPR_FUNCTION, pos: name.pos, text: strings.ToLower(name.text)}
+	// count(*) is a call without arguments.
+	if parser_accept(parser, TOKEN_RPAREN) {
+		return expr
+	}
+	if parser.token.tt == TOKEN_STAR {
+		parser_advance(parser)
+		parser_expect(parser, TOKEN_RPAREN, "\")\"")
+		return expr
+	}
+	for {
+		expr.args = append(expr.args, parse_expression(parser))
+		if !parser_accept(parser, TOKEN_COMMA) {
+			break
+		}
+	}
+	parser_expect(parser, TOKEN_RPAREN, "\")\"")
+	return expr
+}
+
+// parse_number reads a numeric literal. Like SQLite, an integer too large
+// for 64 bits becomes a real.
+func parse_number(token Token, negative bool) *Expr {
+	text := token.text
+	if negative {
+		text = "-" + text
+	}
+	if !strings.ContainsAny(text, ".eE") {
+		if value, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return &Expr{et: EXPR_INTEGER, pos: token.pos, integer: value}
+		}
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil && !math.IsInf(value, 0) {
+		parser_fail(token.pos, "malformed number %s", token.text)
+	}
+	return &Expr{et: EXPR_REAL, pos: token.pos, real: value}
+}
+
+func parse_integer(token Token, negative bool) *Expr {
+	text := token.text
+	if negative {
+		text = "-" + text
+	}
+	if strings.ContainsAny(text, ".eE") {
+		parser_fail(token.pos, "%s is not an integer", token.text)
+	}
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		parser_fail(token.pos, "integer %s is out of range", token.text)
+	}
+	return &Expr{et: EXPR_INTEGER, pos: token.pos, integer: value}
+}
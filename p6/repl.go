@@ -2,57 +2,95 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
-	"strconv"
+	"slices"
+	"sort"
 	"strings"
-	"unsafe"
 )
 
-const COLUMN_USERNAME_SIZE = 32
-const COLUMN_EMAIL_SIZE = 256
-
-const PAGE_SIZE = 4096
-const TABLE_MAX_PAGES = 100
-
 type MetaCommandResult int
 type PrepareCommandState int
 type StatementType int
 type ExecuteResult int
 
-type Row struct {
-	id       uint32
-	username [COLUMN_USERNAME_SIZE]byte
-	email    [COLUMN_EMAIL_SIZE]byte
-}
-
+// Statement holds the parsed form of a statement followed by what
+// prepare_statement derives from it for execution.
 type Statement struct {
-	row_to_insert Row
-	st            StatementType
+	st                 StatementType
+	table_name         string
+	table_pos          int
+	shorthand_insert   bool               // insert <id> <username> <email>
+	columns            []string           // insert column list, empty means all columns
+	column_definitions []ColumnDefinition // create table, or the column alter table adds
+	if_exists          bool               // drop table
+	alter_action       AlterAction
+	column_name        string // column alter table renames
+	column_pos         int
+	new_name           string // new name of the table or column alter table renames
+	new_name_pos       int
+	pragma_name        string
+	pragma_pos         int
+	pragma_value       string // empty when the pragma is only read
+	pragma_value_pos   int
+	values             [][]*Expr      // insert rows
+	assignments        []Assignment   // update
+	result_columns     []ResultColumn // select list, empty means *
+	where              *Expr          // nil matches every row
+	reverse            bool           // select rows last to first
+	group_by           []*Expr
+	having             *Expr
+	order_by           []OrderTerm
+	limit              *Expr
+	offset             *Expr
+
+	table          *Table  // table the statement works on
+	schema         *Schema // schema of table, or the one CREATE or ALTER TABLE gives it
+	create_users   bool    // the users table has to be created before the statement runs
+	rows_to_insert [][]Value
+	updates        []ColumnUpdate
+	start_key      int64
+	end_key        int64
+	limit_count    int64 // -1 for no limit
+	offset_count   int64
+	aggregates     []*Expr // aggregate calls of a select, see collect_aggregates
+	grouped        bool    // select has GROUP BY or aggregates
 }
 
-type Page struct {
-	data [PAGE_SIZE]byte
+// ColumnUpdate is a SET assignment bound to the column it changes.
+type ColumnUpdate struct {
+	column int
+	value  Value
 }
 
+// Table is a B-tree of rows laid out as schema says. The root page of a
+// table never changes once it is created.
 type Table struct {
-	num_rows uint32
-	pager    *Pager
+	root_page_num uint32
+	pager         *Pager
+	schema        *Schema
 }
 
-type Pager struct {
-	file_descriptor *os.File
-	file_length     uint32
-	pages           [TABLE_MAX_PAGES]*Page
+// Database is an open database file: the catalog and the tables it lists,
+// in the order they were created. in_transaction is set from BEGIN until
+// COMMIT or ROLLBACK, otherwise every statement is committed on its own.
+type Database struct {
+	pager          *Pager
+	catalog        *Table
+	tables         []*Table
+	in_transaction bool
 }
 
+// Cursor points at a cell of a leaf node, end_of_table is set once it has
+// moved past the last cell of the rightmost leaf.
 type Cursor struct {
 	table        *Table
-	row_num      uint32
+	page_num     uint32
+	cell_num     uint32
 	end_of_table bool
 }
 
@@ -62,286 +100,1201 @@ const (
 )
 const (
 	PREPARE_COMMAND_SUCCESS PrepareCommandState = iota
-	PREPARE_STRING_TOO_LONG
-	PREPARE_NEGATIVE_ID
 	PREPARE_SYNTAX_ERROR
 	PREPARE_UNRECOGNIZED_STATEMENT
 )
 const (
 	STATEMENT_INSERT StatementType = iota
 	STATEMENT_SELECT
+	STATEMENT_DELETE
+	STATEMENT_UPDATE
+	STATEMENT_CREATE_TABLE
+	STATEMENT_DROP_TABLE
+	STATEMENT_ALTER_TABLE
+	STATEMENT_VACUUM
+	STATEMENT_PRAGMA
+	STATEMENT_BEGIN
+	STATEMENT_COMMIT
+	STATEMENT_ROLLBACK
 )
 const (
 	EXECUTE_SUCCESS ExecuteResult = iota
 	EXECUTE_UNKNOWN
 	EXECUTE_TABLE_FULL
+	EXECUTE_DUPLICATE_KEY
+	EXECUTE_FAILED // the error has been printed already
 )
 
-var (
-	ID_SIZE       uint32
-	USERNAME_SIZE uint32
-	EMAIL_SIZE    uint32
-	ROW_SIZE      uint32
+// db_open opens or creates a database file, a new one with pages of
+// pageSize bytes, keeping up to cacheSize pages in memory. A file that
+// does not start with a valid header is refused, as it is not a database
+// or has another format.
+func db_open(filename string, pageSize uint32, cacheSize int) (*Database, error) {
+	pager, err := pager_open(filename, pageSize, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	db := &Database{
+		pager:   pager,
+		catalog: &Table{root_page_num: CATALOG_ROOT_PAGE_NUM, pager: pager, schema: parse_schema(CATALOG_TABLE_SQL)},
+	}
+	if pager.num_pages == 0 {
+		// New database file. Page 1 is the root of the empty catalog.
+		get_page_for_write(pager, HEADER_PAGE_NUM)
+		root := get_page_for_write(pager, CATALOG_ROOT_PAGE_NUM).data
+		initialize_leaf_node(root)
+		set_node_root(root, true)
+		// A rollback goes back to the last commit, so there has to be one.
+		pager_commit(pager)
+	} else {
+		nodeType := get_node_type(get_page(pager, CATALOG_ROOT_PAGE_NUM).data)
+		if nodeType != NODE_LEAF && nodeType != NODE_INTERNAL {
+			pager.file_descriptor.Close()
+			return nil, fmt.Errorf("file %s is corrupt: page %d is not the catalog", filename, CATALOG_ROOT_PAGE_NUM)
+		}
+		load_catalog(db)
+	}
+	log.Printf("INFO: db_open: Opened database file %s with %d pages and %d tables\n", filename, pager.num_pages, len(db.tables))
+	return db, nil
+}
+
+// find_table looks a table up by name, the catalog included.
+func find_table(db *Database, name string) *Table {
+	if strings.EqualFold(name, CATALOG_TABLE_NAME) || strings.EqualFold(name, "sqlite_master") {
+		return db.catalog
+	}
+	for _, table := range db.tables {
+		if strings.EqualFold(table.schema.name, name) {
+			return table
+		}
+	}
+	return nil
+}
 
-	ID_OFFSET       uint32
-	USERNAME_OFFSET uint32
-	EMAIL_OFFSET    uint32
+// create_table gives the table an empty root leaf and records it in the
+// catalog.
+func create_table(db *Database, schema *Schema) ExecuteResult {
+	rootPageNum := get_unused_page_num(db.pager)
+	root := get_page_for_write(db.pager, rootPageNum).data
+	initialize_leaf_node(root)
+	set_node_root(root, true)
 
-	ROWS_PER_PAGE  uint32
-	TABLE_MAX_ROWS uint32
-)
+	entry := []Value{text_value("table"), text_value(schema.name), text_value(schema.name), integer_value(int64(rootPageNum)), text_value(schema.sql)}
+	if result := insert_row(entry, db.catalog); result != EXECUTE_SUCCESS {
+		free_page(db.pager, rootPageNum)
+		return result
+	}
+	db.tables = append(db.tables, &Table{root_page_num: rootPageNum, pager: db.pager, schema: schema})
+	db.pager.header.schema_cookie++
+	log.Printf("INFO: create_table: Created table %s with root page %d\n", schema.name, rootPageNum)
+	return EXECUTE_SUCCESS
+}
 
-func init() {
-	ID_SIZE = uint32(unsafe.Sizeof(Row{}.id))
-	USERNAME_SIZE = uint32(unsafe.Sizeof(Row{}.username))
-	EMAIL_SIZE = uint32(unsafe.Sizeof(Row{}.email))
+// db_close commits what is left to commit and closes the file. A
+// transaction that was never committed is rolled back.
+func db_close(db *Database) {
+	pager := db.pager
+	if db.in_transaction {
+		log.Println("WARNING: db_close: Rolling back the open transaction")
+		pager_rollback(pager)
+		db.in_transaction = false
+	}
+	pager_commit(pager)
+	wal_close(pager)
+	clear(pager.cache)
+	pager.lru.Init()
+	if err := pager.file_descriptor.Close(); err != nil {
+		log.Fatalf("ERROR: db_close: Could not close database file: %v\n", err)
+	}
+}
 
-	ID_OFFSET = 0
-	USERNAME_OFFSET = uint32(unsafe.Offsetof(Row{}.username))
-	EMAIL_OFFSET = uint32(unsafe.Offsetof(Row{}.email))
+// print_header shows the header as it will be written by the next commit.
+func print_header(pager *Pager) {
+	fmt.Printf("format version: %d\n", pager.header.format_version)
+	fmt.Printf("page size: %d\n", pager.header.page_size)
+	fmt.Printf("page count: %d\n", pager.num_pages)
+	fmt.Printf("free list head: %d\n", pager.header.free_list_head)
+	fmt.Printf("schema cookie: %d\n", pager.header.schema_cookie)
+	fmt.Printf("free pages: %d\n", pager.header.free_pages)
+	fmt.Printf("journal mode: %s\n", JOURNAL_MODE_NAMES[pager.header.journal_mode])
+}
 
-	ROW_SIZE = ID_SIZE + USERNAME_SIZE + EMAIL_SIZE
+// print_constants shows the node layout for the page size of the file.
+func print_constants(pager *Pager) {
+	pageSize := pager.page_size
+	fmt.Printf("PAGE_SIZE: %d\n", pageSize)
+	fmt.Printf("COMMON_NODE_HEADER_SIZE: %d\n", COMMON_NODE_HEADER_SIZE)
+	fmt.Printf("LEAF_NODE_HEADER_SIZE: %d\n", LEAF_NODE_HEADER_SIZE)
+	fmt.Printf("LEAF_NODE_SPACE_FOR_CELLS: %d\n", leaf_node_space_for_cells(pageSize))
+	fmt.Printf("LEAF_NODE_MAX_CELL_SIZE: %d\n", leaf_node_max_cell_size(pageSize))
+	fmt.Printf("OVERFLOW_PAGE_SPACE: %d\n", overflow_page_space(pageSize))
+	fmt.Printf("INTERNAL_NODE_MAX_KEYS: %d\n", internal_node_max_keys(pageSize))
+}
 
-	ROWS_PER_PAGE = PAGE_SIZE / ROW_SIZE
-	TABLE_MAX_ROWS = TABLE_MAX_PAGES * ROWS_PER_PAGE
+// print_syntax_error shows the message and points at the offending column.
+func print_syntax_error(input string, err *SyntaxError) {
+	fmt.Printf("Syntax error at column %d: %s\n", err.pos+1, err.msg)
+	fmt.Printf("  %s\n", input)
+	fmt.Printf("  %s^\n", strings.Repeat(" ", err.pos))
+}
 
+func print_prompt() {
+	fmt.Print("db > ")
 }
 
-func serialize_row(row *Row, destination []byte) {
-	binary.LittleEndian.PutUint32(destination[ID_OFFSET:ID_OFFSET+ID_SIZE], row.id)
-	copy(destination[USERNAME_OFFSET:USERNAME_OFFSET+USERNAME_SIZE], row.username[:])
-	copy(destination[EMAIL_OFFSET:EMAIL_OFFSET+EMAIL_SIZE], row.email[:])
+func do_meta_command(input string, db *Database) MetaCommandResult {
+	if strings.Compare(input, ".exit") == 0 {
+		db_close(db)
+		log.Println("INFO: do_meta_command: .exit:\nExiting the program...")
+		os.Exit(0)
+	}
+	if strings.Compare(input, ".help") == 0 {
+		log.Println("INFO: do_meta_command: .help:\nShowing help message...")
+		fmt.Println("Available commands:")
+		fmt.Println("\t.exit - Exit the program")
+		fmt.Println("\t.help - Show this help message")
+		fmt.Println("\t.tables - List the tables")
+		fmt.Println("\t.btree [<table>] - Print the structure of a table's B-tree, the first table by default")
+		fmt.Println("\t.constants - Print the node layout constants")
+		fmt.Println("\t.dbinfo - Print the file header")
+		fmt.Println("\t.vacuum - Same as VACUUM")
+		fmt.Println("\t.checkpoint - Copy the write-ahead log into the database file")
+		fmt.Println("\tinsert <id> <username> <email> - Insert a new row")
+		fmt.Println("\tCREATE TABLE <table> (<column> INTEGER | REAL | TEXT | VARCHAR(<n>) | BLOB [PRIMARY KEY] [NOT NULL] [DEFAULT <value>], ...) - Create a table")
+		fmt.Println("\tDROP TABLE [IF EXISTS] <table> - Delete a table and all its rows")
+		fmt.Println("\tALTER TABLE <table> RENAME TO <name> | RENAME [COLUMN] <column> TO <name> | ADD [COLUMN] <column definition> - Change a table")
+		fmt.Println("\tINSERT INTO <table> [(<column>, ...)] VALUES (<value>, ...) [, (...)] - Insert rows")
+		fmt.Println("\tVACUUM - Rebuild the database file without unused space")
+		fmt.Println("\tPRAGMA journal_mode [= delete | wal] - Show or set how commits are made safe")
+		fmt.Println("\tBEGIN [TRANSACTION] - Start a transaction, statements are committed one by one until then")
+		fmt.Println("\tCOMMIT [TRANSACTION] - Make the changes of the transaction permanent")
+		fmt.Println("\tROLLBACK [TRANSACTION] - Undo the changes of the transaction")
+		fmt.Println("\tselect - Select all rows")
+		fmt.Println("\tselect from <id> - Select rows with id >= <id>")
+		fmt.Println("\tselect desc - Select all rows, last to first")
+		fmt.Println("\tSELECT * | <expr> [AS <alias>], ... FROM <table> [WHERE <condition>]")
+		fmt.Println("\t\t[GROUP BY <expr>, ... [HAVING <condition>]]")
+		fmt.Println("\t\t[ORDER BY <expr> [ASC | DESC], ...] [LIMIT <n> [OFFSET <m>]] - Select rows")
+		fmt.Println("\tupdate <id> set <column> = <value> [, ...] - Change the row with the given id")
+		fmt.Println("\tUPDATE <table> SET <column> = <value> [, ...] [WHERE <condition>] - Change rows")
+		fmt.Println("\tDELETE [FROM <table>] [WHERE <condition>] - Delete rows")
+		fmt.Println("\tThe shorthand forms in lower case work on the users table, which the insert shorthand creates if the database has no tables")
+		fmt.Println("\tConditions use =, !=, <, <=, >, >=, LIKE, IN, BETWEEN, IS [NOT] NULL, AND, OR and NOT")
+		fmt.Println("\tValues are NULL, integers, reals like 1.5, 'text' and blobs like X'0A1B'")
+		fmt.Printf("\tSELECT * FROM %s lists the tables with their root page and CREATE TABLE\n", CATALOG_TABLE_NAME)
+		return META_COMMAND_SUCCESS
+	}
+
+	if strings.Compare(input, ".tables") == 0 {
+		for _, table := range db.tables {
+			fmt.Println(table.schema.name)
+		}
+		return META_COMMAND_SUCCESS
+	}
+
+	if strings.Compare(input, ".dbinfo") == 0 {
+		print_header(db.pager)
+		return META_COMMAND_SUCCESS
+	}
+
+	if strings.Compare(input, ".checkpoint") == 0 {
+		if db.pager.header.journal_mode != JOURNAL_MODE_WAL {
+			fmt.Println("Error: database is not in WAL mode")
+		} else if db.in_transaction {
+			fmt.Println("Error: cannot checkpoint from within a transaction")
+		} else {
+			fmt.Printf("%d pages checkpointed\n", wal_checkpoint(db.pager))
+		}
+		return META_COMMAND_SUCCESS
+	}
+
+	if strings.Compare(input, ".vacuum") == 0 {
+		execute_vacuum(db)
+		return META_COMMAND_SUCCESS
+	}
+
+	if strings.Compare(input, ".constants") == 0 {
+		fmt.Println("Constants:")
+		print_constants(db.pager)
+		return META_COMMAND_SUCCESS
+	}
+
+	fields := strings.Fields(input)
+	if fields[0] == ".btree" && len(fields) <= 2 {
+		var table *Table
+		if len(fields) == 2 {
+			table = find_table(db, fields[1])
+		} else if len(db.tables) > 0 {
+			table = db.tables[0]
+		}
+		fmt.Println("Tree:")
+		if table != nil {
+			print_tree(table.pager, table.root_page_num, 0)
+		}
+		return META_COMMAND_SUCCESS
+	}
+	log.Printf("WARNING: do_meta_command: Unrecognized command %s\n", input)
+	return META_COMMAND_UNRECOGNIZED_COMMAND
+
 }
 
-func deserialize_row(source []byte, row *Row) {
-	row.id = binary.LittleEndian.Uint32(source[ID_OFFSET : ID_OFFSET+ID_SIZE])
-	copy(row.username[:], source[USERNAME_OFFSET:USERNAME_OFFSET+USERNAME_SIZE])
-	copy(row.email[:], source[EMAIL_OFFSET:EMAIL_OFFSET+EMAIL_SIZE])
+func prepare_statement(input string, statement *Statement, db *Database) (PrepareCommandState, *SyntaxError) {
+	ok, err := parse_statement(input, statement)
+	if !ok {
+		log.Printf("WARNING: prepare_statement: Unrecognized command %s\n", input)
+		return PREPARE_UNRECOGNIZED_STATEMENT, nil
+	}
+	if err != nil {
+		log.Printf("WARNING: prepare_statement: %v\n", err)
+		return PREPARE_SYNTAX_ERROR, err
+	}
+	switch statement.st {
+	case STATEMENT_CREATE_TABLE:
+		return prepare_create_table(statement, input, db)
+	case STATEMENT_DROP_TABLE:
+		return prepare_drop_table(statement, db)
+	case STATEMENT_ALTER_TABLE:
+		return prepare_alter_table(statement, db)
+	case STATEMENT_VACUUM, STATEMENT_BEGIN, STATEMENT_COMMIT, STATEMENT_ROLLBACK:
+		return PREPARE_COMMAND_SUCCESS, nil
+	case STATEMENT_PRAGMA:
+		return prepare_pragma(statement)
+	}
+
+	if statement.st == STATEMENT_SELECT && statement.table_name == "" {
+		// SELECT without FROM
+	} else {
+		table := find_table(db, statement.table_name)
+		if table == nil && len(db.tables) == 0 && statement.shorthand_insert {
+			// Created by execute_statement, so a statement that is rejected
+			// leaves the file as it was.
+			statement.create_users = true
+			statement.schema = parse_schema(DEFAULT_TABLE_SQL)
+		} else if table == nil {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("no such table: %s", statement.table_name)}
+		} else if table == db.catalog && statement.st != STATEMENT_SELECT {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("table %s may not be modified", statement.table_name)}
+		} else {
+			statement.table = table
+			statement.schema = table.schema
+		}
+	}
+
+	switch statement.st {
+	case STATEMENT_INSERT:
+		return prepare_insert(statement)
+	case STATEMENT_SELECT:
+		return prepare_select(statement)
+	case STATEMENT_DELETE:
+		return prepare_where(statement)
+	case STATEMENT_UPDATE:
+		if state, err := prepare_update(statement); state != PREPARE_COMMAND_SUCCESS {
+			return state, err
+		}
+		return prepare_where(statement)
+	}
+	return PREPARE_UNRECOGNIZED_STATEMENT, nil
 }
 
-func cursor_value(cursor *Cursor) []byte {
-	rowNum := cursor.row_num
-	pageNum := rowNum / ROWS_PER_PAGE
-	rowOffset := rowNum % ROWS_PER_PAGE
-	byteOffset := rowOffset * ROW_SIZE
-	page := get_page(cursor.table.pager, pageNum)
+// prepare_create_table builds the schema, the SQL is kept as typed so it
+// can be stored in the file.
+func prepare_create_table(statement *Statement, input string, db *Database) (PrepareCommandState, *SyntaxError) {
+	if err := check_table_name(db, statement.table_name, statement.table_pos); err != nil {
+		return PREPARE_SYNTAX_ERROR, err
+	}
+	sql := strings.TrimSuffix(strings.TrimSpace(input), ";")
+	schema, err := schema_from_statement(statement, sql)
+	if err != nil {
+		return PREPARE_SYNTAX_ERROR, err
+	}
+	statement.schema = schema
+	return PREPARE_COMMAND_SUCCESS, nil
+}
 
-	return page.data[byteOffset : byteOffset+ROW_SIZE]
+// check_table_name checks that a new table can be given the name.
+func check_table_name(db *Database, name string, pos int) *SyntaxError {
+	if strings.HasPrefix(strings.ToLower(name), "sqlite_") {
+		return &SyntaxError{pos, fmt.Sprintf("object name reserved for internal use: %s", name)}
+	}
+	if find_table(db, name) != nil {
+		return &SyntaxError{pos, fmt.Sprintf("table %s already exists", name)}
+	}
+	return nil
+}
 
+// prepare_drop_table leaves statement.table nil for DROP TABLE IF EXISTS of
+// a table that does not exist.
+func prepare_drop_table(statement *Statement, db *Database) (PrepareCommandState, *SyntaxError) {
+	table := find_table(db, statement.table_name)
+	if table == nil {
+		if statement.if_exists {
+			return PREPARE_COMMAND_SUCCESS, nil
+		}
+		return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("no such table: %s", statement.table_name)}
+	}
+	if table == db.catalog {
+		return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("table %s may not be dropped", statement.table_name)}
+	}
+	statement.table = table
+	return PREPARE_COMMAND_SUCCESS, nil
 }
 
-func db_open(filename string) *Table {
-	pager := pager_open(filename)
-	numRows := pager.file_length / ROW_SIZE
-	table := &Table{
-		num_rows: numRows,
-		pager:    pager,
+// prepare_alter_table builds the schema the table has after the change.
+// Its SQL is written from the schema, so the catalog keeps a CREATE TABLE
+// that gives the altered table when it is read back.
+func prepare_alter_table(statement *Statement, db *Database) (PrepareCommandState, *SyntaxError) {
+	table := find_table(db, statement.table_name)
+	if table == nil {
+		return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("no such table: %s", statement.table_name)}
+	}
+	if table == db.catalog {
+		return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("table %s may not be altered", statement.table_name)}
+	}
+	statement.table = table
+
+	schema := table.schema
+	name := schema.name
+	definitions := make([]ColumnDefinition, len(schema.columns))
+	for i, column := range schema.columns {
+		definitions[i] = column.definition
+	}
+	switch statement.alter_action {
+	case ALTER_RENAME_TABLE:
+		if !strings.EqualFold(statement.new_name, name) {
+			if err := check_table_name(db, statement.new_name, statement.new_name_pos); err != nil {
+				return PREPARE_SYNTAX_ERROR, err
+			}
+		}
+		name = statement.new_name
+	case ALTER_RENAME_COLUMN:
+		column := find_column(schema, statement.column_name)
+		if column < 0 {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.column_pos, fmt.Sprintf("no such column: %s", statement.column_name)}
+		}
+		if other := find_column(schema, statement.new_name); other >= 0 && other != column {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.new_name_pos, fmt.Sprintf("duplicate column name: %s", statement.new_name)}
+		}
+		definitions[column].name = statement.new_name
+	case ALTER_ADD_COLUMN:
+		definition := statement.column_definitions[0]
+		if definition.primary_key {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{definition.pos, "cannot add a PRIMARY KEY column"}
+		}
+		if definition.not_null && definition.default_value == nil {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{definition.pos, "cannot add a NOT NULL column with default value NULL"}
+		}
+		definitions = append(definitions, definition)
+	}
+
+	altered, err := schema_from_statement(&Statement{table_name: name, column_definitions: definitions}, "")
+	if err != nil {
+		return PREPARE_SYNTAX_ERROR, err
 	}
-	log.Printf("INFO: db_open: Opened database file %s with %d rows\n", filename, table.num_rows)
-	return table
+	altered.sql = schema_sql(altered)
+	statement.schema = altered
+	return PREPARE_COMMAND_SUCCESS, nil
 }
 
-func db_close(table *Table) {
-	numFullPages := table.num_rows / ROWS_PER_PAGE
-	numAdditionalRows := table.num_rows % ROWS_PER_PAGE
+// prepare_pragma checks the pragma, journal_mode is the only one.
+func prepare_pragma(statement *Statement) (PrepareCommandState, *SyntaxError) {
+	if statement.pragma_name != "journal_mode" {
+		return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.pragma_pos, fmt.Sprintf("unknown pragma: %s", statement.pragma_name)}
+	}
+	if statement.pragma_value != "" && !slices.Contains(JOURNAL_MODE_NAMES, statement.pragma_value) {
+		return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.pragma_value_pos, fmt.Sprintf("journal_mode must be one of %s", strings.Join(JOURNAL_MODE_NAMES, ", "))}
+	}
+	return PREPARE_COMMAND_SUCCESS, nil
+}
 
-	for i := 0; i < int(numFullPages); i++ {
-		page := table.pager.pages[i]
-		if page == nil {
-			continue
+// prepare_insert turns the parsed VALUES lists into rows. Columns that are
+// not given get their default, and a missing INTEGER PRIMARY KEY is left
+// NULL for insert_row to assign.
+func prepare_insert(statement *Statement) (PrepareCommandState, *SyntaxError) {
+	schema := statement.schema
+	columns := make([]int, 0, len(schema.columns))
+	if len(statement.columns) == 0 {
+		for i := range schema.columns {
+			columns = append(columns, i)
 		}
-		_, err := table.pager.file_descriptor.WriteAt(page.data[:], int64(i*PAGE_SIZE))
-		if err != nil {
-			log.Fatalf("ERROR: db_close: Could not write page %d to file: %v\n", i, err)
+	}
+	for _, name := range statement.columns {
+		column := find_column(schema, name)
+		if column < 0 {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("table %s has no column named %s", schema.name, name)}
+		}
+		if slices.Contains(columns, column) {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.table_pos, fmt.Sprintf("column %s given more than once", name)}
 		}
+		columns = append(columns, column)
 	}
-	if numAdditionalRows > 0 {
-		page := table.pager.pages[numFullPages]
-		if page == nil {
-			log.Fatalf("ERROR: db_close: Page %d is nil\n", numFullPages)
+
+	for _, values := range statement.values {
+		if len(values) != len(columns) {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{values[0].pos, fmt.Sprintf("%d values for %d columns", len(values), len(columns))}
 		}
-		_, err := table.pager.file_descriptor.WriteAt(page.data[:numAdditionalRows*ROW_SIZE], int64(numFullPages*PAGE_SIZE))
-		if err != nil {
-			log.Fatalf("ERROR: db_close: Could not write additional rows to file: %v\n", err)
+		row := make([]Value, len(schema.columns))
+		for i, column := range schema.columns {
+			if i == schema.key_column {
+				row[i] = null_value()
+			} else {
+				row[i] = column.default_value
+			}
+		}
+		for i, column := range columns {
+			value, state, err := prepare_column_value(schema, column, values[i])
+			if state != PREPARE_COMMAND_SUCCESS {
+				return state, err
+			}
+			row[column] = value
+		}
+		for i, column := range schema.columns {
+			if column.not_null && row[i].vt == VALUE_NULL && i != schema.key_column {
+				return PREPARE_SYNTAX_ERROR, &SyntaxError{values[0].pos, fmt.Sprintf("NOT NULL constraint failed: %s.%s", schema.name, column.name)}
+			}
 		}
+		statement.rows_to_insert = append(statement.rows_to_insert, row)
 	}
+	log.Printf("INFO: prepare_insert: insert statement with %d rows\n", len(statement.rows_to_insert))
+	return PREPARE_COMMAND_SUCCESS, nil
 }
 
-func pager_open(filename string) *Pager {
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Fatalf("ERROR: db_open: Could not open file %s: %v\n", filename, err)
+// prepare_column_value evaluates a constant expression and applies the
+// column's affinity. As in SQLite any column takes values of any type and
+// length, only the INTEGER PRIMARY KEY and NOT NULL are checked.
+func prepare_column_value(schema *Schema, columnIndex int, expr *Expr) (Value, PrepareCommandState, *SyntaxError) {
+	column := &schema.columns[columnIndex]
+	if err := resolve_expr(expr, nil); err != nil {
+		return Value{}, PREPARE_SYNTAX_ERROR, err
 	}
-	offset, err := f.Seek(0, io.SeekEnd) // Move to end of file, returns new offset
+	value, err := eval_constant(expr)
 	if err != nil {
-		// handle error
+		return Value{}, PREPARE_SYNTAX_ERROR, err
+	}
+	value = apply_affinity(column.ct, value)
+	if columnIndex == schema.key_column {
+		// A NULL key is assigned by insert_row.
+		if value.vt != VALUE_INTEGER && value.vt != VALUE_NULL {
+			return Value{}, PREPARE_SYNTAX_ERROR, &SyntaxError{expr.pos, fmt.Sprintf("datatype mismatch: %s must be an integer", column.name)}
+		}
+		return value, PREPARE_COMMAND_SUCCESS, nil
+	}
+
+	if value.vt == VALUE_NULL && column.not_null {
+		return Value{}, PREPARE_SYNTAX_ERROR, &SyntaxError{expr.pos, fmt.Sprintf("NOT NULL constraint failed: %s.%s", schema.name, column.name)}
+	}
+	return value, PREPARE_COMMAND_SUCCESS, nil
+}
+
+// prepare_update binds the SET assignments to their columns.
+func prepare_update(statement *Statement) (PrepareCommandState, *SyntaxError) {
+	schema := statement.schema
+	for _, assignment := range statement.assignments {
+		column := find_column(schema, assignment.column)
+		if column < 0 {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{assignment.pos, fmt.Sprintf("no such column: %s", assignment.column)}
+		}
+		if column == schema.key_column {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{assignment.pos, fmt.Sprintf("%s cannot be updated", assignment.column)}
+		}
+		value, state, err := prepare_column_value(schema, column, assignment.value)
+		if state != PREPARE_COMMAND_SUCCESS {
+			return state, err
+		}
+		statement.updates = append(statement.updates, ColumnUpdate{column: column, value: value})
 	}
-	log.Printf("INFO: pager_open: File %s opened, current offset is %d\n", filename, offset)
-	fileLength := uint32(offset)
+	log.Printf("INFO: prepare_update: update statement setting %d columns\n", len(statement.assignments))
+	return PREPARE_COMMAND_SUCCESS, nil
+}
 
-	pager := &Pager{
-		file_descriptor: f,
-		file_length:     fileLength,
+// select_columns returns the columns a select can refer to.
+func select_columns(statement *Statement) []string {
+	if statement.schema == nil {
+		return nil
 	}
-	return pager
+	return schema_column_names(statement.schema)
 }
 
-func get_page(pager *Pager, pageNum uint32) *Page {
-	if pageNum >= TABLE_MAX_PAGES {
-		log.Fatalf("ERROR: get_page: Page number %d exceeds maximum pages %d\n", pageNum, TABLE_MAX_PAGES)
+func prepare_select(statement *Statement) (PrepareCommandState, *SyntaxError) {
+	columns := select_columns(statement)
+	for _, resultColumn := range statement.result_columns {
+		if err := collect_aggregates(resultColumn.expr, statement, columns); err != nil {
+			return PREPARE_SYNTAX_ERROR, err
+		}
+		if err := resolve_expr(resultColumn.expr, columns); err != nil {
+			return PREPARE_SYNTAX_ERROR, err
+		}
+	}
+	for i, expr := range statement.group_by {
+		expr, err := resolve_result_reference(statement, expr, "GROUP BY")
+		if err != nil {
+			return PREPARE_SYNTAX_ERROR, err
+		}
+		if contains_aggregate(expr) {
+			return PREPARE_SYNTAX_ERROR, &SyntaxError{statement.group_by[i].pos, "aggregate functions are not allowed in the GROUP BY clause"}
+		}
+		if err := resolve_expr(expr, columns); err != nil {
+			return PREPARE_SYNTAX_ERROR, err
+		}
+		statement.group_by[i] = expr
+	}
+	if err := collect_aggregates(statement.having, statement, columns); err != nil {
+		return PREPARE_SYNTAX_ERROR, err
 	}
-	if pager.pages[pageNum] == nil {
-		log.Printf("INFO: get_page: Page %d was nil! Allocating new page\n", pageNum)
-		page := &Page{}
+	if err := resolve_expr(statement.having, columns); err != nil {
+		return PREPARE_SYNTAX_ERROR, err
+	}
+	if err := prepare_order_by(statement, columns); err != nil {
+		return PREPARE_SYNTAX_ERROR, err
+	}
+	statement.grouped = len(statement.group_by) > 0 || len(statement.aggregates) > 0 || statement.having != nil
 
-		num_pages := pager.file_length / PAGE_SIZE
-		if pager.file_length%PAGE_SIZE != 0 {
-			num_pages += 1
+	statement.limit_count = -1
+	if statement.limit != nil {
+		limit, err := prepare_constant_integer(statement.limit, "LIMIT")
+		if err != nil {
+			return PREPARE_SYNTAX_ERROR, err
+		}
+		// A negative limit means no limit, as in SQLite.
+		statement.limit_count = max(limit, -1)
+	}
+	if statement.offset != nil {
+		offset, err := prepare_constant_integer(statement.offset, "OFFSET")
+		if err != nil {
+			return PREPARE_SYNTAX_ERROR, err
 		}
+		statement.offset_count = max(offset, 0)
+	}
+	return prepare_where(statement)
+}
 
-		if pageNum < num_pages {
-			_, err := pager.file_descriptor.ReadAt(page.data[:], int64(pageNum*PAGE_SIZE))
-			if err != nil && err != io.EOF {
-				log.Fatalf("ERROR: get_page: Could not read page %d from file: %v\n", pageNum, err)
+// resolve_result_reference lets GROUP BY and ORDER BY name a result column
+// by its number or its alias, the columns of SELECT * being those of the
+// table. Anything else is returned unchanged.
+func resolve_result_reference(statement *Statement, expr *Expr, clause string) (*Expr, *SyntaxError) {
+	switch expr.et {
+	case EXPR_INTEGER:
+		if len(statement.result_columns) == 0 {
+			names := select_columns(statement)
+			if expr.integer >= 1 && expr.integer <= int64(len(names)) {
+				return &Expr{et: EXPR_COLUMN, pos: expr.pos, text: names[expr.integer-1]}, nil
+			}
+		} else if expr.integer >= 1 && expr.integer <= int64(len(statement.result_columns)) {
+			return statement.result_columns[expr.integer-1].expr, nil
+		}
+		return nil, &SyntaxError{expr.pos, fmt.Sprintf("%s term %d out of range", clause, expr.integer)}
+	case EXPR_COLUMN:
+		for _, resultColumn := range statement.result_columns {
+			if strings.EqualFold(resultColumn.name, expr.text) {
+				return resultColumn.expr, nil
 			}
 		}
-		pager.pages[pageNum] = page
+	}
+	return expr, nil
+}
+
+// prepare_order_by resolves ORDER BY terms. Ordering a plain select by id
+// first is what the scan does anyway, so that case only sets the scan
+// direction and leaves order_by empty.
+func prepare_order_by(statement *Statement, columns []string) *SyntaxError {
+	for i := range statement.order_by {
+		term := &statement.order_by[i]
+		expr, err := resolve_result_reference(statement, term.expr, "ORDER BY")
+		if err != nil {
+			return err
+		}
+		if err := collect_aggregates(expr, statement, columns); err != nil {
+			return err
+		}
+		if err := resolve_expr(expr, columns); err != nil {
+			return err
+		}
+		term.expr = expr
+	}
+
+	grouped := len(statement.group_by) > 0 || len(statement.aggregates) > 0
+	if len(statement.order_by) > 0 && statement.table_name != "" && !grouped && is_key_column(statement, statement.order_by[0].expr) {
+		statement.reverse = statement.order_by[0].descending
+		statement.order_by = nil
+	}
+	return nil
+}
+
+// prepare_constant_integer evaluates an expression that may not refer to
+// columns, such as LIMIT, and checks that it is an integer.
+func prepare_constant_integer(expr *Expr, clause string) (int64, *SyntaxError) {
+	if err := resolve_expr(expr, nil); err != nil {
+		return 0, err
+	}
+	value, err := eval_constant(expr)
+	if err != nil {
+		return 0, err
+	}
+	if value.vt != VALUE_INTEGER {
+		return 0, &SyntaxError{expr.pos, fmt.Sprintf("%s must be an integer", clause)}
+	}
+	return value.integer, nil
+}
+
+// prepare_where resolves the columns of the WHERE clause and narrows the
+// scan down to an inclusive range of ids where the clause allows it. The
+// clause itself is still checked against every row in the range.
+func prepare_where(statement *Statement) (PrepareCommandState, *SyntaxError) {
+	if err := resolve_expr(statement.where, select_columns(statement)); err != nil {
+		return PREPARE_SYNTAX_ERROR, err
+	}
+	if statement.schema != nil {
+		apply_comparison_affinity(statement.schema, statement.where)
+	}
+	low, high := int64(math.MinInt64), int64(math.MaxInt64)
+	where_key_range(statement, statement.where, &low, &high)
+	if low > high {
+		// Nothing matches, an empty range with start_key > end_key.
+		low, high = 1, 0
+	}
+	statement.start_key = low
+	statement.end_key = high
+	log.Printf("INFO: prepare_where: scanning ids %d to %d\n", statement.start_key, statement.end_key)
+	return PREPARE_COMMAND_SUCCESS, nil
+}
+
+// apply_comparison_affinity converts constants compared with a column the
+// way the column would store them, as SQLite does, so id = '5' finds the
+// row with id 5 and a TEXT column compared with 5 is compared with '5'.
+func apply_comparison_affinity(schema *Schema, expr *Expr) {
+	if expr == nil {
+		return
+	}
+	switch expr.et {
+	case EXPR_BINARY:
+		switch expr.op {
+		case "=", "!=", "<", "<=", ">", ">=":
+			convert_constant(schema, expr.left, expr.right)
+			convert_constant(schema, expr.right, expr.left)
+		}
+	case EXPR_BETWEEN, EXPR_IN:
+		for _, arg := range expr.args {
+			convert_constant(schema, expr.left, arg)
+		}
+	}
+	apply_comparison_affinity(schema, expr.left)
+	apply_comparison_affinity(schema, expr.right)
+	for _, arg := range expr.args {
+		apply_comparison_affinity(schema, arg)
+	}
+}
 
+func convert_constant(schema *Schema, column *Expr, constant *Expr) {
+	if column.et != EXPR_COLUMN {
+		return
+	}
+	switch constant.et {
+	case EXPR_INTEGER, EXPR_REAL, EXPR_STRING:
+		value := apply_affinity(schema.columns[column.column].ct, eval_expr(constant, nil))
+		*constant = *value_expr(value, constant.pos)
 	}
-	return pager.pages[pageNum]
 }
 
-func table_start(table *Table) *Cursor {
-	return &Cursor{
-		table:        table,
-		row_num:      0,
-		end_of_table: table.num_rows == 0,
+// where_key_range narrows [low, high] using the comparisons of the key
+// column with an integer that are ANDed together at the top of the clause.
+// Anything else is left to row_matches.
+func where_key_range(statement *Statement, expr *Expr, low *int64, high *int64) {
+	if expr == nil {
+		return
 	}
+	switch expr.et {
+	case EXPR_BINARY:
+		if expr.op == "AND" {
+			where_key_range(statement, expr.left, low, high)
+			where_key_range(statement, expr.right, low, high)
+			return
+		}
+		column, value, op := expr.left, expr.right, expr.op
+		if column.et == EXPR_INTEGER {
+			// 5 < id is id > 5
+			column, value = value, column
+			op = map[string]string{"=": "=", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}[op]
+		}
+		if !is_key_column(statement, column) || value.et != EXPR_INTEGER {
+			return
+		}
+		switch op {
+		case "=":
+			*low = max(*low, value.integer)
+			*high = min(*high, value.integer)
+		case "<":
+			if value.integer == math.MinInt64 {
+				*low, *high = 1, 0
+				return
+			}
+			*high = min(*high, value.integer-1)
+		case "<=":
+			*high = min(*high, value.integer)
+		case ">":
+			if value.integer == math.MaxInt64 {
+				*low, *high = 1, 0
+				return
+			}
+			*low = max(*low, value.integer+1)
+		case ">=":
+			*low = max(*low, value.integer)
+		}
+	case EXPR_BETWEEN:
+		lower, upper := expr.args[0], expr.args[1]
+		if is_key_column(statement, expr.left) && lower.et == EXPR_INTEGER && upper.et == EXPR_INTEGER {
+			*low = max(*low, lower.integer)
+			*high = min(*high, upper.integer)
+		}
+	}
+}
+
+// is_key_column reports whether expr is the INTEGER PRIMARY KEY column,
+// whose values are the keys of the B-tree.
+func is_key_column(statement *Statement, expr *Expr) bool {
+	key := statement.schema.key_column
+	return key >= 0 && expr.et == EXPR_COLUMN && expr.column == key
 }
 
-func table_end(table *Table) *Cursor {
-	return &Cursor{
-		table:        table,
-		row_num:      table.num_rows,
-		end_of_table: true,
+func execute_create_table(statement *Statement, db *Database) ExecuteResult {
+	return create_table(db, statement.schema)
+}
+
+// execute_drop_table removes the table from the catalog and frees every
+// page of its B-tree.
+func execute_drop_table(statement *Statement, db *Database) ExecuteResult {
+	table := statement.table
+	if table == nil {
+		return EXECUTE_SUCCESS
 	}
+	leaf_node_delete(find_catalog_entry(db, table.schema.name))
+	free_tree(table.pager, table.root_page_num)
+	db.tables = slices.DeleteFunc(db.tables, func(t *Table) bool { return t == table })
+	db.pager.header.schema_cookie++
+	log.Printf("INFO: execute_drop_table: Dropped table %s, %d pages are free\n", table.schema.name, db.pager.header.free_pages)
+	return EXECUTE_SUCCESS
 }
 
-func cursor_advance(cursor *Cursor) {
-	cursor.row_num += 1
-	if cursor.row_num >= cursor.table.num_rows {
-		cursor.end_of_table = true
+// execute_pragma shows the journal mode after setting it, if the pragma
+// gives one.
+func execute_pragma(statement *Statement, db *Database) ExecuteResult {
+	if statement.pragma_value != "" && db.in_transaction {
+		fmt.Println("Error: cannot change the journal mode from within a transaction")
+		return EXECUTE_FAILED
+	}
+	if statement.pragma_value != "" {
+		set_journal_mode(db.pager, JournalMode(slices.Index(JOURNAL_MODE_NAMES, statement.pragma_value)))
 	}
+	fmt.Println(statement.pragma_name)
+	fmt.Println(JOURNAL_MODE_NAMES[db.pager.header.journal_mode])
+	return EXECUTE_SUCCESS
 }
 
-func print_prompt() {
-	fmt.Print("db > ")
+// execute_vacuum rebuilds the database file and says how much smaller it got.
+func execute_vacuum(db *Database) ExecuteResult {
+	if db.in_transaction {
+		fmt.Println("Error: cannot VACUUM from within a transaction")
+		return EXECUTE_FAILED
+	}
+	reclaimed, err := vacuum_database(db)
+	if err != nil {
+		log.Printf("ERROR: execute_vacuum: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
+		return EXECUTE_FAILED
+	}
+	fmt.Printf("%d bytes reclaimed\n", reclaimed)
+	return EXECUTE_SUCCESS
 }
 
-func do_meta_command(input string, table *Table) MetaCommandResult {
-	if strings.Compare(input, ".exit") == 0 {
-		db_close(table)
-		log.Println("INFO: do_meta_command: .exit:\nExiting the program...")
-		os.Exit(0)
+// execute_alter_table rewrites the catalog entry. Rows written before a
+// column was added have no value for it and read back its default, so no
+// row needs to change.
+func execute_alter_table(statement *Statement, db *Database) ExecuteResult {
+	table := statement.table
+	name := table.schema.name
+	table.schema = statement.schema
+	update_catalog_entry(db, name, table)
+	db.pager.header.schema_cookie++
+	return EXECUTE_SUCCESS
+}
+
+func execute_insert(statement *Statement, table *Table) ExecuteResult {
+	for _, row := range statement.rows_to_insert {
+		pager_release(table.pager)
+		if result := insert_row(row, table); result != EXECUTE_SUCCESS {
+			return result
+		}
 	}
-	if strings.Compare(input, ".help") == 0 {
-		log.Println("INFO: do_meta_command: .help:\nShowing help message...")
-		fmt.Println("Available commands:")
-		fmt.Println("\t.exit - Exit the program")
-		fmt.Println("\t.help - Show this help message")
-		fmt.Println("\tinsert <id> <username> <email> - Insert a new row")
-		fmt.Println("\tselect - Select all rows")
-		return META_COMMAND_SUCCESS
+	return EXECUTE_SUCCESS
+}
+
+// insert_row uses the INTEGER PRIMARY KEY as the key, or one more than the
+// largest key when there is none or it was left NULL.
+func insert_row(row []Value, table *Table) ExecuteResult {
+	schema := table.schema
+	var key int64
+	if schema.key_column >= 0 && row[schema.key_column].vt != VALUE_NULL {
+		key = row[schema.key_column].integer
+	} else {
+		key = 1
+		if last := table_last(table); !last.end_of_table {
+			if cursor_key(last) == math.MaxInt64 {
+				log.Println("ERROR: insert_row: No key left to assign")
+				return EXECUTE_TABLE_FULL
+			}
+			key = cursor_key(last) + 1
+		}
+		if schema.key_column >= 0 {
+			row[schema.key_column] = integer_value(key)
+		}
+	}
+	return table_insert(table, key, row)
+}
+
+// table_insert adds a row under the given key unless the key is taken.
+func table_insert(table *Table, key int64, row []Value) ExecuteResult {
+	cursor := table_find(table, key)
+	node := get_page(table.pager, cursor.page_num).data
+	if cursor.cell_num < leaf_node_num_cells(node) && leaf_node_key(node, cursor.cell_num) == key {
+		log.Printf("WARNING: table_insert: Duplicate key %d\n", key)
+		return EXECUTE_DUPLICATE_KEY
 	}
-	log.Printf("WARNING: do_meta_command: Unrecognized command %s\n", input)
-	return META_COMMAND_UNRECOGNIZED_COMMAND
 
+	leaf_node_insert(cursor, key, serialize_row(table.schema, row))
+	log.Printf("INFO: table_insert: Inserted row with key %d\n", key)
+	return EXECUTE_SUCCESS
+}
+
+// table_update replaces the row under the cursor. The new record may have
+// a different size, so the cell is deleted and inserted again.
+func table_update(table *Table, cursor *Cursor, row []Value) {
+	key := cursor_key(cursor)
+	payload := serialize_row(table.schema, row)
+	leaf_node_delete(cursor)
+	leaf_node_insert(table_find(table, key), key, payload)
+	log.Printf("INFO: table_update: Updated row with key %d\n", key)
 }
 
-func prepare_statement(input string, statement *Statement) PrepareCommandState {
-	if len(input) >= 6 && strings.Compare(input[:6], "insert") == 0 {
-		statement.st = STATEMENT_INSERT
-		splits := strings.SplitN(input, " ", 4)
-		if len(splits) != 4 {
-			log.Printf("WARNING: prepare_statement: splits = %v, expected 4 parts", splits)
-			return PREPARE_SYNTAX_ERROR
+func execute_select(st *Statement, table *Table) ExecuteResult {
+	if len(st.result_columns) > 0 {
+		names := make([]string, len(st.result_columns))
+		for i, resultColumn := range st.result_columns {
+			names[i] = resultColumn.name
 		}
-		id, err := strconv.Atoi(splits[1])
-		if err != nil {
-			log.Printf("WARNING: prepare_statement: id = %v is not numeric", splits[1])
-			return PREPARE_SYNTAX_ERROR
-		} else if id < 0 {
-			log.Printf("WARNING: prepare_statement: id = %d is negative", id)
-			return PREPARE_NEGATIVE_ID
+		fmt.Println(strings.Join(names, " | "))
+	}
+
+	// A plain select prints rows as they are scanned and stops at the
+	// limit. Grouped rows and rows to sort are collected first.
+	output := ResultOutput{statement: st}
+	grouping := Grouping{statement: st, groups: map[string]*Group{}}
+	var sorted []SortedRow
+	numRows := scan_select(st, table, func(row []Value) bool {
+		switch {
+		case st.grouped:
+			grouping_add(&grouping, row)
+		case len(st.order_by) > 0:
+			sorted = append(sorted, sort_key(st.order_by, row))
+		default:
+			output_row(&output, row)
 		}
+		return !output_done(&output)
+	})
 
-		if len(splits[2]) > COLUMN_USERNAME_SIZE {
-			log.Printf("WARNING: prepare_statement: username %s is too long, max size is %d", splits[2], COLUMN_USERNAME_SIZE)
-			return PREPARE_STRING_TOO_LONG
-		} else if len(splits[3]) > COLUMN_EMAIL_SIZE {
-			log.Printf("WARNING: prepare_statement: email %s is too long, max size is %d", splits[3], COLUMN_EMAIL_SIZE)
-			return PREPARE_STRING_TOO_LONG
+	if st.grouped {
+		for _, row := range grouping_rows(&grouping, len(select_columns(st))) {
+			if len(st.order_by) > 0 {
+				sorted = append(sorted, sort_key(st.order_by, row))
+			} else {
+				output_row(&output, row)
+			}
+		}
+	}
+	if len(st.order_by) > 0 {
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return compare_sort_keys(st.order_by, sorted[i].keys, sorted[j].keys) < 0
+		})
+		for i := 0; i < len(sorted) && !output_done(&output); i++ {
+			output_row(&output, sorted[i].row)
 		}
+	}
 
-		statement.row_to_insert.id = uint32(id)
-		copy(statement.row_to_insert.username[:COLUMN_USERNAME_SIZE], splits[2])
-		copy(statement.row_to_insert.email[:COLUMN_EMAIL_SIZE], splits[3])
+	log.Printf("INFO: execute_select: Selected %d rows\n", numRows)
+	return EXECUTE_SUCCESS
+}
 
-		log.Printf("INFO: prepare_statement: insert statement\n")
-		return PREPARE_COMMAND_SUCCESS
+// scan_select calls visit with the values of every row that passes WHERE,
+// in key order or reversed, until visit returns false. A select without a
+// table visits a single empty row. It returns the number of rows visited.
+func scan_select(st *Statement, table *Table, visit func(row []Value) bool) int {
+	if st.table_name == "" {
+		visit([]Value{})
+		return 1
+	}
 
-	} else if len(input) >= 6 && strings.Compare(input, "select") == 0 {
-		statement.st = STATEMENT_SELECT
-		log.Println("INFO: prepare_statement: select statement")
-		return PREPARE_COMMAND_SUCCESS
+	var cursor *Cursor
+	if st.reverse {
+		cursor = table_seek_reverse(table, st.end_key)
 	} else {
-		log.Printf("WARNING: prepare_statement: Unrecognized command %s\n", input)
-		return PREPARE_UNRECOGNIZED_STATEMENT
+		cursor = table_seek(table, st.start_key)
+	}
+
+	numRows := 0
+	for !cursor.end_of_table {
+		pager_release(table.pager)
+		key := cursor_key(cursor)
+		if key < st.start_key || key > st.end_key {
+			break
+		}
+		row := cursor_row(cursor)
+		if row_matches(st.where, row) {
+			numRows += 1
+			if !visit(row) {
+				break
+			}
+		}
+		if st.reverse {
+			cursor_prev(cursor)
+		} else {
+			cursor_advance(cursor)
+		}
 	}
+	return numRows
 }
 
-func execute_insert(statement *Statement, table *Table) ExecuteResult {
-	if table.num_rows >= TABLE_MAX_ROWS {
-		log.Println("ERROR: execute_insert: Table full")
-		return EXECUTE_TABLE_FULL
+// ResultOutput applies OFFSET and LIMIT to the rows of a select.
+type ResultOutput struct {
+	statement *Statement
+	skipped   int64
+	printed   int64
+}
+
+func output_done(output *ResultOutput) bool {
+	return output.statement.limit_count >= 0 && output.printed >= output.statement.limit_count
+}
+
+func output_row(output *ResultOutput, row []Value) {
+	if output.skipped < output.statement.offset_count {
+		output.skipped += 1
+		return
+	}
+	if output_done(output) {
+		return
 	}
-	cursor := table_end(table)
-	serialize_row(&statement.row_to_insert, cursor_value(cursor))
-	table.num_rows += 1
+	print_result_row(output.statement, row)
+	output.printed += 1
+}
+
+// SortedRow is a row waiting to be sorted by ORDER BY, keys holds the value
+// of each term so they are evaluated only once.
+type SortedRow struct {
+	row  []Value
+	keys []Value
+}
 
-	if table.num_rows > TABLE_MAX_ROWS {
-		log.Println("WARNING: execute_insert: Table full after insert")
+func sort_key(orderBy []OrderTerm, row []Value) SortedRow {
+	keys := make([]Value, len(orderBy))
+	for i, term := range orderBy {
+		keys[i] = eval_expr(term.expr, row)
 	}
-	log.Printf("INFO: execute_insert: Inserted row id = %d, username = %s, email = %s\n", statement.row_to_insert.id, string(statement.row_to_insert.username[:]), string(statement.row_to_insert.email[:]))
-	return EXECUTE_SUCCESS
+	return SortedRow{row: row, keys: keys}
 }
 
-func execute_select(st *Statement, table *Table) ExecuteResult {
-	row := &Row{}
-	if table.num_rows == 0 {
-		log.Println("INFO: execute_select: No rows to select")
-		return EXECUTE_SUCCESS
+// compare_sort_keys orders NULL before any other value, as SQLite does.
+func compare_sort_keys(orderBy []OrderTerm, a []Value, b []Value) int {
+	for i, term := range orderBy {
+		var result int
+		switch {
+		case a[i].vt == VALUE_NULL && b[i].vt == VALUE_NULL:
+			result = 0
+		case a[i].vt == VALUE_NULL:
+			result = -1
+		case b[i].vt == VALUE_NULL:
+			result = 1
+		default:
+			result = compare_values(a[i], b[i])
+		}
+		if term.descending {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+// print_result_row prints the whole row as a tuple for SELECT *, otherwise
+// the values of the result columns separated like the header.
+func print_result_row(st *Statement, row []Value) {
+	if len(st.result_columns) == 0 {
+		values := make([]string, len(select_columns(st)))
+		for i := range values {
+			values[i] = value_to_display(row[i])
+		}
+		fmt.Printf("(%s)\n", strings.Join(values, " "))
+		return
+	}
+	values := make([]string, len(st.result_columns))
+	for i, resultColumn := range st.result_columns {
+		values[i] = value_to_display(eval_expr(resultColumn.expr, row))
+	}
+	fmt.Println(strings.Join(values, " | "))
+}
+
+func execute_delete(statement *Statement, table *Table) ExecuteResult {
+	numDeleted := 0
+	cursor := table_seek(table, statement.start_key)
+	for !cursor.end_of_table {
+		pager_release(table.pager)
+		key := cursor_key(cursor)
+		if key > statement.end_key {
+			break
+		}
+		if !row_matches(statement.where, cursor_row(cursor)) {
+			cursor_advance(cursor)
+			continue
+		}
+		leaf_node_delete(cursor)
+		numDeleted += 1
+		// The delete may have removed the leaf, so look the next row up again.
+		cursor = table_seek(table, key)
 	}
-	cursor := table_start(table)
 
+	fmt.Printf("%d rows deleted\n", numDeleted)
+	log.Printf("INFO: execute_delete: Deleted %d rows\n", numDeleted)
+	return EXECUTE_SUCCESS
+}
+
+func execute_update(statement *Statement, table *Table) ExecuteResult {
+	numUpdated := 0
+	cursor := table_seek(table, statement.start_key)
 	for !cursor.end_of_table {
-		deserialize_row(cursor_value(cursor), row)
-		trimmedUsername := strings.TrimRight(string(row.username[:]), "\x00")
-		trimmedEmail := strings.TrimRight(string(row.email[:]), "\x00")
-		fmt.Printf("(%d %s %s)\n", row.id, trimmedUsername, trimmedEmail)
-		cursor_advance(cursor)
+		pager_release(table.pager)
+		key := cursor_key(cursor)
+		if key > statement.end_key {
+			break
+		}
+		row := cursor_row(cursor)
+		if !row_matches(statement.where, row) {
+			cursor_advance(cursor)
+			continue
+		}
+		for _, update := range statement.updates {
+			row[update.column] = update.value
+		}
+		table_update(table, cursor, row)
+		numUpdated += 1
+		if key == math.MaxInt64 {
+			break
+		}
+		// The row was inserted again and leaves may have split or merged,
+		// so look the next row up again.
+		cursor = table_seek(table, key+1)
 	}
 
-	log.Printf("INFO: execute_select: Selected %d rows\n", table.num_rows)
+	fmt.Printf("%d rows updated\n", numUpdated)
+	log.Printf("INFO: execute_update: Updated %d rows\n", numUpdated)
+	return EXECUTE_SUCCESS
+}
+
+// execute_transaction starts, commits or rolls back a transaction. The
+// commit itself is left to end_statement, which commits once no
+// transaction is open.
+func execute_transaction(statement *Statement, db *Database) ExecuteResult {
+	switch {
+	case statement.st == STATEMENT_BEGIN && db.in_transaction:
+		fmt.Println("Error: cannot start a transaction within a transaction")
+		return EXECUTE_FAILED
+	case statement.st == STATEMENT_COMMIT && !db.in_transaction:
+		fmt.Println("Error: cannot commit - no transaction is active")
+		return EXECUTE_FAILED
+	case statement.st == STATEMENT_ROLLBACK && !db.in_transaction:
+		fmt.Println("Error: cannot rollback - no transaction is active")
+		return EXECUTE_FAILED
+	}
+	db.in_transaction = statement.st == STATEMENT_BEGIN
+	if statement.st == STATEMENT_ROLLBACK {
+		pager_rollback(db.pager)
+		reload_catalog(db)
+	}
 	return EXECUTE_SUCCESS
 }
 
-func execute_statement(statement *Statement, table *Table) ExecuteResult {
+// begin_statement makes a statement inside a transaction undoable on its
+// own. Outside of one undoing the whole transaction does the same.
+func begin_statement(db *Database) {
+	if db.in_transaction {
+		pager_begin_statement(db.pager)
+	}
+}
+
+// end_statement commits a statement that went through unless a transaction
+// is open, and undoes one that failed, so a statement never changes the
+// database halfway.
+func end_statement(db *Database, result ExecuteResult) {
+	pager := db.pager
+	switch {
+	case result == EXECUTE_SUCCESS && db.in_transaction:
+		pager_end_statement(pager)
+	case result == EXECUTE_SUCCESS:
+		pager_commit(pager)
+	case db.in_transaction:
+		pager_rollback_statement(pager)
+		reload_catalog(db)
+	default:
+		pager_rollback(pager)
+		reload_catalog(db)
+	}
+}
+
+// reload_catalog reads the tables from the catalog again after a rollback,
+// which may have undone CREATE, DROP or ALTER TABLE.
+func reload_catalog(db *Database) {
+	db.tables = nil
+	load_catalog(db)
+}
+
+// execute_statement runs a prepared statement. An expression that cannot be
+// evaluated ends it with an error, end_statement then undoes what it did.
+func execute_statement(statement *Statement, db *Database) (result ExecuteResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			evalError, isEvalError := r.(*EvalError)
+			if !isEvalError {
+				panic(r)
+			}
+			log.Printf("ERROR: execute_statement: %v\n", evalError)
+			fmt.Printf("Error: %v\n", evalError)
+			result = EXECUTE_FAILED
+		}
+	}()
+	if statement.create_users {
+		if result := create_table(db, statement.schema); result != EXECUTE_SUCCESS {
+			return result
+		}
+		statement.table = find_table(db, statement.table_name)
+	}
+	table := statement.table
 	switch statement.st {
 	case STATEMENT_INSERT:
 		return execute_insert(statement, table)
 	case STATEMENT_SELECT:
 		return execute_select(statement, table)
+	case STATEMENT_DELETE:
+		return execute_delete(statement, table)
+	case STATEMENT_UPDATE:
+		return execute_update(statement, table)
+	case STATEMENT_CREATE_TABLE:
+		return execute_create_table(statement, db)
+	case STATEMENT_DROP_TABLE:
+		return execute_drop_table(statement, db)
+	case STATEMENT_ALTER_TABLE:
+		return execute_alter_table(statement, db)
+	case STATEMENT_VACUUM:
+		return execute_vacuum(db)
+	case STATEMENT_PRAGMA:
+		return execute_pragma(statement, db)
+	case STATEMENT_BEGIN, STATEMENT_COMMIT, STATEMENT_ROLLBACK:
+		return execute_transaction(statement, db)
 	}
 	return EXECUTE_UNKNOWN
 }
@@ -349,6 +1302,8 @@ func execute_statement(statement *Statement, table *Table) ExecuteResult {
 func main() {
 	debugPtr := flag.Bool("debug", false, "Enable debug mode")
 	dbFile := flag.String("db", "test.db", "Database file to open")
+	pageSize := flag.Uint("page-size", DEFAULT_PAGE_SIZE, "Page size of a new database file, a power of two from 512 to 65536")
+	cacheSize := flag.Int("cache-size", DEFAULT_CACHE_SIZE, "Number of pages to keep in memory")
 	flag.Parse()
 	if *debugPtr {
 		log.SetOutput(os.Stdout)
@@ -356,27 +1311,40 @@ func main() {
 		log.SetOutput(io.Discard) // Disable debug output
 	}
 
-	log.Printf("INFO: init: ID_SIZE = %d, USERNAME_SIZE = %d, EMAIL_SIZE = %d\n", ID_SIZE, USERNAME_SIZE, EMAIL_SIZE)
-	log.Printf("INFO: init: ID_OFFSET = %d, USERNAME_OFFSET = %d, EMAIL_OFFSET = %d\n", ID_OFFSET, USERNAME_OFFSET, EMAIL_OFFSET)
-	log.Printf("INFO: init: ROW_SIZE = %d, ROWS_PER_PAGE = %d, TABLE_MAX_ROWS = %d\n", ROW_SIZE, ROWS_PER_PAGE, TABLE_MAX_ROWS)
-
-	table := db_open(*dbFile)
+	if !is_valid_page_size(uint32(*pageSize)) || *pageSize > MAX_PAGE_SIZE {
+		fmt.Fprintf(os.Stderr, "Error: page size %d is not a power of two from %d to %d\n", *pageSize, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+		os.Exit(1)
+	}
+	if *cacheSize < 1 {
+		fmt.Fprintf(os.Stderr, "Error: cache size %d is not a positive number of pages\n", *cacheSize)
+		os.Exit(1)
+	}
+	db, err := db_open(*dbFile, uint32(*pageSize), *cacheSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 	reader := bufio.NewReader(os.Stdin)
 	for {
+		// Nothing holds on to pages between statements.
+		pager_release(db.pager)
 		print_prompt()
 		input_w_delim, err := reader.ReadString('\n')
-		input := input_w_delim[:len(input_w_delim)-1]
 		if err != nil {
 			if err == io.EOF {
-				db_close(table)
+				db_close(db)
 				break
 			}
 			// better error handling
 			break
 		}
+		input := input_w_delim[:len(input_w_delim)-1]
 
+		if strings.TrimSpace(input) == "" {
+			continue
+		}
 		if input[0] == '.' {
-			switch do_meta_command(input, table) {
+			switch do_meta_command(input, db) {
 			case META_COMMAND_SUCCESS:
 				continue
 			case META_COMMAND_UNRECOGNIZED_COMMAND:
@@ -385,38 +1353,38 @@ func main() {
 			}
 		}
 		statement := &Statement{}
-		switch prepare_statement(input, statement) {
+		state, syntaxError := prepare_statement(input, statement, db)
+		switch state {
 		case PREPARE_COMMAND_SUCCESS:
 			break
 		case PREPARE_SYNTAX_ERROR:
-			fmt.Println("Syntax error. Could not parse statement. Following are the valid commands:")
-			do_meta_command(".help", table)
-			continue
-		case PREPARE_STRING_TOO_LONG:
-			fmt.Printf("String is too long. Maximum size is %d for username and %d for email\n", COLUMN_USERNAME_SIZE, COLUMN_EMAIL_SIZE)
-			continue
-		case PREPARE_NEGATIVE_ID:
-			fmt.Println("ID must be a positive integer")
+			print_syntax_error(input, syntaxError)
 			continue
 		case PREPARE_UNRECOGNIZED_STATEMENT:
 			fmt.Printf("Unrecognized keyword at start of %s. following are the valid commands:\n", input)
-			do_meta_command(".help", table)
+			do_meta_command(".help", db)
 			continue
 		}
 		// var statement Statement
 		// statement.st = ss
 
-		switch execute_statement(statement, table) {
+		begin_statement(db)
+		result := execute_statement(statement, db)
+		// The statement is committed or undone before it is reported.
+		end_statement(db, result)
+		switch result {
 		case EXECUTE_SUCCESS:
 			fmt.Printf("Executed\n")
 			if *debugPtr {
-				log.Printf("INFO: execute_statement: Executed. Table now has %d rows\n", table.num_rows)
+				log.Printf("INFO: execute_statement: Executed. Database now has %d pages\n", db.pager.num_pages)
 			}
 		case EXECUTE_TABLE_FULL:
 			fmt.Println("Error: Table full")
 			if *debugPtr {
 				log.Println("ERROR: execute_statement: Table full")
 			}
+		case EXECUTE_DUPLICATE_KEY:
+			fmt.Println("Error: Duplicate key")
 		case EXECUTE_UNKNOWN:
 			fmt.Println("Error: Uknown error")
 		}
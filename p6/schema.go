@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+// ColumnType is the affinity of a column, which decides how values are
+// converted when they are stored in it.
+type ColumnType int
+
+const (
+	COLUMN_INTEGER ColumnType = iota
+	COLUMN_REAL
+	COLUMN_NUMERIC
+	COLUMN_TEXT
+	COLUMN_BLOB
+)
+
+// Rows are stored as records like SQLite's: a header with its own size and
+// a serial type for every column as varints, followed by the values. The
+// serial type gives the type and size of a value.
+const (
+	SERIAL_TYPE_NULL  = 0
+	SERIAL_TYPE_INT8  = 1 // 2 to 6 are integers of 2, 3, 4, 6 and 8 bytes
+	SERIAL_TYPE_INT64 = 6
+	SERIAL_TYPE_REAL  = 7
+	SERIAL_TYPE_ZERO  = 8
+	SERIAL_TYPE_ONE   = 9
+	SERIAL_TYPE_BLOB  = 12 // 12 + 2n is a blob of n bytes
+	SERIAL_TYPE_TEXT  = 13 // 13 + 2n is text of n bytes
+)
+
+var SERIAL_INTEGER_SIZES = [...]int{0, 1, 2, 3, 4, 6, 8}
+
+// DEFAULT_TABLE_SQL is the table the shorthand insert and select work on.
+// It is created when a statement uses it in a database without tables.
+const DEFAULT_TABLE_SQL = "CREATE TABLE users (id INTEGER PRIMARY KEY, username VARCHAR(32), email VARCHAR(256))"
+
+// Column is one column of a table.
+type Column struct {
+	name          string
+	ct            ColumnType
+	not_null      bool
+	primary_key   bool
+	default_value Value            // what an insert without the column stores
+	definition    ColumnDefinition // as written, to write the CREATE TABLE again
+}
+
+// Schema describes a table created by CREATE TABLE. sql is the statement
+// that created it, which is what the file keeps.
+type Schema struct {
+	name       string
+	sql        string
+	columns    []Column
+	key_column int // the INTEGER PRIMARY KEY column, -1 when rows get a rowid
+}
+
+// schema_from_statement builds the schema of a parsed CREATE TABLE.
+func schema_from_statement(statement *Statement, sql string) (*Schema, *SyntaxError) {
+	schema := &Schema{name: statement.table_name, sql: sql, key_column: -1}
+	for _, definition := range statement.column_definitions {
+		for _, column := range schema.columns {
+			if strings.EqualFold(column.name, definition.name) {
+				return nil, &SyntaxError{definition.pos, fmt.Sprintf("duplicate column name: %s", definition.name)}
+			}
+		}
+
+		column := Column{
+			name:          definition.name,
+			ct:            column_affinity(definition.type_name),
+			not_null:      definition.not_null,
+			primary_key:   definition.primary_key,
+			default_value: null_value(),
+			definition:    definition,
+		}
+		// Lengths are kept for the SQL but, as in SQLite, not enforced.
+		if definition.size != 0 && column.ct != COLUMN_TEXT && column.ct != COLUMN_BLOB {
+			return nil, &SyntaxError{definition.pos, fmt.Sprintf("%s does not take a length", definition.type_name)}
+		}
+
+		if definition.primary_key {
+			if schema.key_column >= 0 {
+				return nil, &SyntaxError{definition.pos, fmt.Sprintf("table %s has more than one primary key", schema.name)}
+			}
+			if column.ct != COLUMN_INTEGER {
+				return nil, &SyntaxError{definition.pos, "only an INTEGER column can be the PRIMARY KEY"}
+			}
+			schema.key_column = len(schema.columns)
+		}
+		schema.columns = append(schema.columns, column)
+
+		if definition.default_value != nil {
+			value, state, err := prepare_column_value(schema, len(schema.columns)-1, definition.default_value)
+			if state != PREPARE_COMMAND_SUCCESS {
+				return nil, err
+			}
+			schema.columns[len(schema.columns)-1].default_value = value
+		}
+	}
+	log.Printf("INFO: schema_from_statement: table %s has %d columns\n", schema.name, len(schema.columns))
+	return schema, nil
+}
+
+// column_affinity derives the affinity from the declared type the way
+// SQLite does, so any type name is accepted.
+func column_affinity(typeName string) ColumnType {
+	typeName = strings.ToUpper(typeName)
+	switch {
+	case strings.Contains(typeName, "INT"):
+		return COLUMN_INTEGER
+	case strings.Contains(typeName, "CHAR"), strings.Contains(typeName, "CLOB"), strings.Contains(typeName, "TEXT"):
+		return COLUMN_TEXT
+	case strings.Contains(typeName, "BLOB"):
+		return COLUMN_BLOB
+	case strings.Contains(typeName, "REAL"), strings.Contains(typeName, "FLOA"), strings.Contains(typeName, "DOUB"):
+		return COLUMN_REAL
+	}
+	return COLUMN_NUMERIC
+}
+
+// apply_affinity converts a value that is about to be stored in a column:
+// numeric columns turn text that reads as a number into one, and a real
+// without a fraction into an integer except in REAL columns, where every
+// number is real. TEXT columns store numbers as text. BLOB columns keep
+// values as they are.
+func apply_affinity(ct ColumnType, value Value) Value {
+	switch ct {
+	case COLUMN_TEXT:
+		if is_numeric(value) {
+			return text_value(value_to_text(value))
+		}
+	case COLUMN_INTEGER, COLUMN_NUMERIC, COLUMN_REAL:
+		if value.vt == VALUE_TEXT {
+			if number, ok := text_to_number(value.text); ok {
+				value = number
+			}
+		}
+		if ct == COLUMN_REAL && value.vt == VALUE_INTEGER {
+			return real_value(float64(value.integer))
+		}
+		if ct != COLUMN_REAL && value.vt == VALUE_REAL && value.real == math.Trunc(value.real) && math.Abs(value.real) < 1<<63 {
+			return integer_value(int64(value.real))
+		}
+	}
+	return value
+}
+
+// parse_schema rebuilds a schema from the CREATE TABLE stored in the file.
+func parse_schema(sql string) *Schema {
+	statement := &Statement{}
+	ok, err := parse_statement(sql, statement)
+	if ok && err == nil && statement.st == STATEMENT_CREATE_TABLE {
+		var schema *Schema
+		if schema, err = schema_from_statement(statement, sql); err == nil {
+			return schema
+		}
+	}
+	log.Fatalf("ERROR: parse_schema: Stored schema %q is not a valid CREATE TABLE: %v\n", sql, err)
+	return nil
+}
+
+// schema_sql writes the CREATE TABLE for a schema. ALTER TABLE stores this
+// in place of the statement the table was created with.
+func schema_sql(schema *Schema) string {
+	definitions := make([]string, len(schema.columns))
+	for i, column := range schema.columns {
+		definition := column.definition
+		text := quote_identifier(column.name) + " " + definition.type_name
+		if definition.size != 0 {
+			text += fmt.Sprintf("(%d)", definition.size)
+		}
+		if definition.primary_key {
+			text += " PRIMARY KEY"
+		}
+		if definition.not_null {
+			text += " NOT NULL"
+		}
+		if definition.default_value != nil {
+			text += " DEFAULT " + sql_literal(column.default_value)
+		}
+		definitions[i] = text
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", quote_identifier(schema.name), strings.Join(definitions, ", "))
+}
+
+// quote_identifier quotes a name unless it can be read back as it is.
+func quote_identifier(name string) string {
+	plain := name != "" && is_identifier_start(name[0]) && !KEYWORDS[strings.ToUpper(name)]
+	for i := 0; i < len(name) && plain; i++ {
+		plain = is_identifier_start(name[i]) || is_digit(name[i])
+	}
+	if plain {
+		return name
+	}
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
+func sql_literal(value Value) string {
+	switch value.vt {
+	case VALUE_NULL:
+		return "NULL"
+	case VALUE_TEXT:
+		return "'" + strings.ReplaceAll(value.text, "'", "''") + "'"
+	case VALUE_BLOB:
+		return fmt.Sprintf("X'%X'", value.text)
+	}
+	return value_to_text(value)
+}
+
+func schema_column_names(schema *Schema) []string {
+	names := make([]string, len(schema.columns))
+	for i, column := range schema.columns {
+		names[i] = column.name
+	}
+	return names
+}
+
+// find_column returns the index of the named column, or -1.
+func find_column(schema *Schema, name string) int {
+	for i, column := range schema.columns {
+		if strings.EqualFold(column.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+const CATALOG_ROOT_PAGE_NUM = 1
+const CATALOG_TABLE_NAME = "sqlite_schema"
+
+// CATALOG_TABLE_SQL is the layout of the catalog, which like SQLite's has a
+// row for every table with the page its B-tree starts on and the SQL that
+// created it. The catalog is a table itself and its root is always page 1.
+const CATALOG_TABLE_SQL = "CREATE TABLE " + CATALOG_TABLE_NAME + " (type text, name text, tbl_name text, rootpage integer, sql text)"
+
+// Catalog columns
+const (
+	CATALOG_TYPE = iota
+	CATALOG_NAME
+	CATALOG_TABLE
+	CATALOG_ROOT_PAGE
+	CATALOG_SQL
+)
+
+// load_catalog rebuilds the tables of db from its catalog.
+func load_catalog(db *Database) {
+	for cursor := table_start(db.catalog); !cursor.end_of_table; cursor_advance(cursor) {
+		entry := cursor_row(cursor)
+		if entry[CATALOG_TYPE].text != "table" {
+			continue
+		}
+		table := &Table{
+			root_page_num: uint32(entry[CATALOG_ROOT_PAGE].integer),
+			pager:         db.pager,
+			schema:        parse_schema(entry[CATALOG_SQL].text),
+		}
+		db.tables = append(db.tables, table)
+		log.Printf("INFO: load_catalog: Table %s has root page %d\n", table.schema.name, table.root_page_num)
+	}
+}
+
+// find_catalog_entry returns a cursor at the catalog row of the named table.
+func find_catalog_entry(db *Database, name string) *Cursor {
+	for cursor := table_start(db.catalog); !cursor.end_of_table; cursor_advance(cursor) {
+		entry := cursor_row(cursor)
+		if entry[CATALOG_TYPE].text == "table" && strings.EqualFold(entry[CATALOG_NAME].text, name) {
+			return cursor
+		}
+	}
+	log.Fatalf("ERROR: find_catalog_entry: Table %s is not in the catalog\n", name)
+	return nil
+}
+
+// update_catalog_entry records the new name, root page and SQL of a table
+// that was altered.
+func update_catalog_entry(db *Database, name string, table *Table) {
+	cursor := find_catalog_entry(db, name)
+	entry := cursor_row(cursor)
+	entry[CATALOG_NAME] = text_value(table.schema.name)
+	entry[CATALOG_TABLE] = text_value(table.schema.name)
+	entry[CATALOG_ROOT_PAGE] = integer_value(int64(table.root_page_num))
+	entry[CATALOG_SQL] = text_value(table.schema.sql)
+	table_update(db.catalog, cursor, entry)
+	log.Printf("INFO: update_catalog_entry: Table %s is now %s with root page %d\n", name, table.schema.name, table.root_page_num)
+}
+
+// serial_type returns the serial type of a value and its size in a record.
+// Integers take the fewest bytes that hold them.
+func serial_type(value Value) (uint64, int) {
+	switch value.vt {
+	case VALUE_INTEGER:
+		switch value.integer {
+		case 0:
+			return SERIAL_TYPE_ZERO, 0
+		case 1:
+			return SERIAL_TYPE_ONE, 0
+		}
+		for st := SERIAL_TYPE_INT8; st < SERIAL_TYPE_INT64; st++ {
+			bits := SERIAL_INTEGER_SIZES[st] * 8
+			if value.integer >= -1<<(bits-1) && value.integer < 1<<(bits-1) {
+				return uint64(st), SERIAL_INTEGER_SIZES[st]
+			}
+		}
+		return SERIAL_TYPE_INT64, 8
+	case VALUE_REAL:
+		return SERIAL_TYPE_REAL, 8
+	case VALUE_TEXT:
+		return SERIAL_TYPE_TEXT + 2*uint64(len(value.text)), len(value.text)
+	case VALUE_BLOB:
+		return SERIAL_TYPE_BLOB + 2*uint64(len(value.text)), len(value.text)
+	}
+	return SERIAL_TYPE_NULL, 0
+}
+
+// serialize_row encodes a row as a record. The INTEGER PRIMARY KEY is the
+// key of the cell, so the record stores NULL for it.
+func serialize_row(schema *Schema, row []Value) []byte {
+	var types, body []byte
+	for i, value := range row {
+		if i == schema.key_column {
+			value = null_value()
+		}
+		st, size := serial_type(value)
+		types = binary.AppendUvarint(types, st)
+		switch {
+		case value.vt == VALUE_INTEGER && size > 0:
+			var buffer [8]byte
+			binary.BigEndian.PutUint64(buffer[:], uint64(value.integer))
+			body = append(body, buffer[8-size:]...)
+		case value.vt == VALUE_REAL:
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(value.real))
+		case value.vt == VALUE_TEXT, value.vt == VALUE_BLOB:
+			body = append(body, value.text...)
+		}
+	}
+	// The header size counts itself, so its varint may need more bytes.
+	headerSize := len(types) + 1
+	for int(uvarint_size(uint32(headerSize))) > headerSize-len(types) {
+		headerSize++
+	}
+	record := binary.AppendUvarint(nil, uint64(headerSize))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// deserialize_row decodes the record of the row with the given key.
+// Columns added after the row was written are not in the record and get
+// their default value.
+func deserialize_row(schema *Schema, key int64, record []byte) []Value {
+	row := make([]Value, len(schema.columns))
+	headerSize, n := binary.Uvarint(record)
+	header := record[n:headerSize]
+	body := record[headerSize:]
+	for i, column := range schema.columns {
+		if len(header) == 0 {
+			row[i] = column.default_value
+			continue
+		}
+		st, n := binary.Uvarint(header)
+		header = header[n:]
+		switch {
+		case st == SERIAL_TYPE_NULL:
+			row[i] = null_value()
+		case st <= SERIAL_TYPE_INT64:
+			size := SERIAL_INTEGER_SIZES[st]
+			var buffer [8]byte
+			if body[0]&0x80 != 0 {
+				copy(buffer[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+			}
+			copy(buffer[8-size:], body[:size])
+			row[i] = integer_value(int64(binary.BigEndian.Uint64(buffer[:])))
+			body = body[size:]
+		case st == SERIAL_TYPE_REAL:
+			row[i] = real_value(math.Float64frombits(binary.BigEndian.Uint64(body)))
+			body = body[8:]
+		case st == SERIAL_TYPE_ZERO:
+			row[i] = integer_value(0)
+		case st == SERIAL_TYPE_ONE:
+			row[i] = integer_value(1)
+		case st >= SERIAL_TYPE_BLOB:
+			size := (st - SERIAL_TYPE_BLOB) / 2
+			row[i] = Value{vt: VALUE_BLOB, text: string(body[:size])}
+			if st%2 == 1 {
+				row[i].vt = VALUE_TEXT
+			}
+			body = body[size:]
+		default:
+			log.Fatalf("ERROR: deserialize_row: Column %s has unknown serial type %d, the file is corrupt\n", column.name, st)
+		}
+	}
+	if schema.key_column >= 0 {
+		row[schema.key_column] = integer_value(key)
+	}
+	return row
+}
+
+// cursor_row decodes the row under the cursor.
+func cursor_row(cursor *Cursor) []Value {
+	return deserialize_row(cursor.table.schema, cursor_key(cursor), cursor_payload(cursor))
+}
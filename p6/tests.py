@@ -1,10 +1,12 @@
+import glob
 import os
 import pytest
 import subprocess
+import tempfile
 
-def run_script(commands):
+def run_script(commands, args=()):
     with subprocess.Popen(
-        ["go", "run", "p6/repl.go", "-db", "something.db"],  # Pass the filename!
+        ["go", "run", *sorted(glob.glob("p6/*.go")), "-db", "something.db", *args],  # Pass the filename!
         stdin=subprocess.PIPE, 
         stdout=subprocess.PIPE, 
         stderr=subprocess.PIPE, text=True
@@ -16,6 +18,10 @@ def run_script(commands):
 
 
 
+# Only the insert shorthand creates the users table, SQL statements need it
+# to exist.
+CREATE_USERS_SQL = "create table users (id integer primary key, username varchar(32), email varchar(256))"
+
 def run_insert(n=10, user_id=None, username=None, email=None):
     commands = []
     outputs = ["db > Executed"] * n
@@ -60,12 +66,65 @@ def test_table_full():
     if os.path.exists("something.db"):
         os.remove("something.db")
 
-    commands, outputs = run_insert(1401)
-    commands.append('.exit')
-    outputs[-1] = "db > Error: Table full"
+    # The file has no page limit, a table is only full once there is no
+    # key left to give a new row.
+    commands = [
+        "create table t (id integer primary key, v text)",
+        "insert into t values (9223372036854775807, 'last')",
+        "insert into t (v) values ('one more')",
+        "insert into t values (1, 'first')",
+        ".exit",
+    ]
     results = run_script(commands)
-    for result, output in zip(results, outputs):
-        assert result == output, f"Expected: {output}, but got: {result}"
+    assert results == ["db > Executed", "db > Executed", "db > Error: Table full", "db > Executed", "db > "], results
+
+def test_page_cache():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    # Far more pages than the cache holds, so pages are evicted and read
+    # back all the time.
+    commands, _ = run_insert(1500, email='a' * 250 + '@example.com')
+    commands.extend(["delete from users where id < 500", "update users set username = 'x' where id >= 1400", ".exit"])
+    run_script(commands, args=["-cache-size", "4"])
+    assert os.path.getsize("something.db") > 100 * 4096
+
+    results = run_script(["select count(*), min(id), max(id), count(username = 'x' or null) from users", ".exit"], args=["-cache-size", "4"])
+    assert results == ["db > count(*) | min(id) | max(id) | count(username = 'x' or null)", "1000 | 500 | 1499 | 100", "Executed", "db > "], results
+
+def test_btree_structure():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    # Rows of 300 bytes with their cell pointer, 13 fit in a leaf.
+    commands = [f"insert {i} user{i:02d}{'x' * 257} person{i:02d}@example.com" for i in range(14, 0, -1)]
+    commands.extend([".btree", ".exit"])
+    results = run_script(commands)
+
+    expected = [
+        "db > Tree:",
+        "- internal (size 1)",
+        "  - leaf (size 7)",
+        *[f"    - {i}" for i in range(1, 8)],
+        "  - key 7",
+        "  - leaf (size 7)",
+        *[f"    - {i}" for i in range(8, 15)],
+        "db > ",
+    ]
+    assert results[14:] == expected, f"Expected: {expected}, but got: {results[14:]}"
+
+def test_select_returns_rows_in_key_order():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    ids = [5, 3, 20, 1, 17, 9, 12, 2, 30, 7, 25, 4, 11, 6, 15]
+    commands = [f"insert {i} user{i} person{i}@example.com" for i in ids]
+    commands.extend(["select", ".exit"])
+    results = run_script(commands)
+
+    selected = [r.replace("db > ", "") for r in results[len(ids):] if r.replace("db > ", "").startswith("(")]
+    expected = [f"({i} user{i} person{i}@example.com)" for i in sorted(ids)]
+    assert selected == expected, f"Expected: {expected}, but got: {selected}"
 
 def test_insert_max_column_size(username_size=64, email_size=512):
     if os.path.exists("something.db"):
@@ -81,7 +140,7 @@ def test_insert_max_column_size(username_size=64, email_size=512):
     commands.extend(["select", ".exit"])
     result = run_script(commands)
     
-    for result, output in zip(result, select_output):
+    for result, output in zip(result[1:], select_output):
         assert result == output, f"Expected: {output}, but got: {result}"
 
 def test_insert_persistence():
@@ -97,4 +156,1022 @@ def test_insert_persistence():
 
 
     for result, output in zip(select_results, select_outputs):
-        assert result == output, f"Expected: {output}, but got: {result}"
\ No newline at end of file
+        assert result == output, f"Expected: {output}, but got: {result}"
+
+def test_select_desc():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands, _ = run_insert(30)
+    commands.extend(["select desc", ".exit"])
+    results = run_script(commands)
+
+    selected = [r.replace("db > ", "") for r in results[30:] if r.replace("db > ", "").startswith("(")]
+    expected = [f"({i} user#{i} user{i}@example.com)" for i in range(29, -1, -1)]
+    assert selected == expected, f"Expected: {expected}, but got: {selected}"
+
+def test_select_from_key():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [f"insert {i} user{i} person{i}@example.com" for i in range(0, 60, 2)]
+    commands.extend(["select from 31", ".exit"])
+    results = run_script(commands)
+
+    selected = [r.replace("db > ", "") for r in results[30:] if r.replace("db > ", "").startswith("(")]
+    expected = [f"({i} user{i} person{i}@example.com)" for i in range(32, 60, 2)]
+    assert selected == expected, f"Expected: {expected}, but got: {selected}"
+
+def test_duplicate_key():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "insert 1 user1 person1@example.com",
+        "insert 1 user1 person1@example.com",
+        "select",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Error: Duplicate key",
+        "db > (1 user1 person1@example.com)",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_delete():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands, _ = run_insert(40)
+    commands.extend([
+        "delete where id = 3",
+        "delete where id = 3",
+        "delete where id between 10 and 35",
+        "select",
+        ".exit",
+    ])
+    results = run_script(commands)
+
+    assert results[40:43] == ["db > 1 rows deleted", "Executed", "db > 0 rows deleted"]
+    assert results[44] == "db > 26 rows deleted"
+    selected = [r.replace("db > ", "") for r in results[45:] if r.replace("db > ", "").startswith("(")]
+    expected = [f"({i} user#{i} user{i}@example.com)" for i in range(40) if i != 3 and not 10 <= i <= 35]
+    assert selected == expected, f"Expected: {expected}, but got: {selected}"
+
+def test_delete_reuses_pages():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands, _ = run_insert(200)
+    commands.append('.exit')
+    run_script(commands)
+    size_before = os.path.getsize("something.db")
+
+    commands, _ = run_insert(200)
+    commands = ["delete where id between 0 and 199"] + commands + ['.exit']
+    results = run_script(commands)
+    assert results[0] == "db > 200 rows deleted"
+    assert os.path.getsize("something.db") == size_before
+
+def test_update():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "insert 1 user1 person1@example.com",
+        "insert 2 user2 person2@example.com",
+        "update 1 set email=new1@example.com",
+        "update 2 set username=bob, email=bob@example.com",
+        "update 3 set username=nobody",
+        "select",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > 1 rows updated",
+        "Executed",
+        "db > 1 rows updated",
+        "Executed",
+        "db > 0 rows updated",
+        "Executed",
+        "db > (1 user1 new1@example.com)",
+        "(2 bob bob@example.com)",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_sql_insert_and_select():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        CREATE_USERS_SQL,
+        "INSERT INTO users VALUES (2, 'jane doe', 'jane@example.com'), (1, 'it''s me', 'me@example.com')",
+        "insert   into users (email, id, username)   values ('x@example.com', 3, 'x');",
+        "Select * From users Where id >= 2 -- skip the first user",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > (2 jane doe jane@example.com)",
+        "(3 x x@example.com)",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_syntax_error_position():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "select * form users",
+        "insert into users values (1, 'unterminated)",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Syntax error at column 10: expected FROM but found \"form\"",
+        "  select * form users",
+        "           ^",
+        "db > Syntax error at column 30: unterminated string",
+        "  insert into users values (1, 'unterminated)",
+        "                               ^",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_where_filters():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        CREATE_USERS_SQL,
+        "insert into users values (1, 'alice', 'alice@corp.com'), (2, 'bob', 'bob@home.org'), (11, 'carol', 'carol@CORP.com'), (12, 'dave', 'dave@corp.com')",
+        "select * from users where id > 10 and email like '%@corp.com'",
+        "select * from users where username in ('bob', 'dave') or not id != 1",
+        "select * from users where id not between 2 and 11 and email is not null",
+        "delete from users where username like '_o%'",
+        "select",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > (11 carol carol@CORP.com)",
+        "(12 dave dave@corp.com)",
+        "Executed",
+        "db > (1 alice alice@corp.com)",
+        "(2 bob bob@home.org)",
+        "(12 dave dave@corp.com)",
+        "Executed",
+        "db > (1 alice alice@corp.com)",
+        "(12 dave dave@corp.com)",
+        "Executed",
+        "db > 1 rows deleted",
+        "Executed",
+        "db > (1 alice alice@corp.com)",
+        "(11 carol carol@CORP.com)",
+        "(12 dave dave@corp.com)",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_select_columns_and_expressions():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        CREATE_USERS_SQL,
+        "insert into users values (1, 'alice', 'alice@corp.com'), (2, 'bob', 'bob@home.org')",
+        "select email, id from users",
+        "select id * 2, upper(username) as name from users where id = 2",
+        "select length('abc') || 'x', 7 / 0",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > email | id",
+        "alice@corp.com | 1",
+        "bob@home.org | 2",
+        "Executed",
+        "db > id * 2 | name",
+        "4 | BOB",
+        "Executed",
+        "db > length('abc') || 'x' | 7 / 0",
+        "3x | NULL",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_substr_extreme_arguments():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    maxint = "9223372036854775807"
+    minint = "(-9223372036854775807 - 1)"
+    commands = [
+        f"select substr('abc', 2, {maxint}) as a, substr('abc', {minint}, {maxint}) as b, substr('abc', {maxint}, {minint}) as c, substr('abc', 2, {minint}) as d",
+        f"select substr('abc', {minint}, {minint}) as a, substr('abc', 0, {maxint}) as b, substr('abcdef', -2, -{maxint}) as c, substr('abc', {maxint}) as d",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > a | b | c | d",
+        "bc | ab | abc | a",
+        "Executed",
+        "db > a | b | c | d",
+        " | abc | abcd | ",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_order_by_and_limit():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        CREATE_USERS_SQL,
+        "insert into users values (1, 'carol', 'c@b.com'), (2, 'alice', 'a@b.com'), (3, 'bob', 'b@a.com'), (4, 'dave', 'd@a.com')",
+        "select * from users order by username limit 2",
+        "select username as u from users order by u desc limit 2 offset 1",
+        "select id from users order by id desc limit 1, 2",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > (2 alice a@b.com)",
+        "(3 bob b@a.com)",
+        "Executed",
+        "db > u",
+        "carol",
+        "bob",
+        "Executed",
+        "db > id",
+        "3",
+        "2",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_order_by_number_with_star():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table g (a integer, b text)",
+        "insert into g values (1, 'x'), (2, 'z'), (3, 'y')",
+        "select * from g order by 2 desc",
+        "select * from g order by 3",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > (2 z)",
+        "(3 y)",
+        "(1 x)",
+        "Executed",
+        "db > Syntax error at column 26: ORDER BY term 3 out of range",
+        "  select * from g order by 3",
+        "                           ^",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_aggregates_and_group_by():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        CREATE_USERS_SQL,
+        "insert into users values (1, 'carol', 'c@b.com'), (2, 'alice', 'a@b.com'), (3, 'bob', 'b@a.com'), (4, 'dave', 'd@a.com'), (5, 'erin', 'e@c.com')",
+        "select substr(email, instr(email, '@') + 1) as domain, count(*) from users group by domain",
+        "select count(*), min(username), max(id), sum(id), avg(id) from users",
+        "select substr(email, 3) as domain, sum(id) from users group by domain having count(*) > 1 order by 2 desc",
+        "select sum(id) from users where id > 10",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > domain | count(*)",
+        "a.com | 2",
+        "b.com | 2",
+        "c.com | 1",
+        "Executed",
+        "db > count(*) | min(username) | max(id) | sum(id) | avg(id)",
+        "5 | alice | 5 | 15 | 3.0",
+        "Executed",
+        "db > domain | sum(id)",
+        "a.com | 7",
+        "b.com | 3",
+        "Executed",
+        "db > sum(id)",
+        "NULL",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_group_by_keeps_large_integers_apart():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table g (v blob)",
+        "insert into g values (9007199254740993), (9007199254740992), (1), (1.0), (0.1), (0.30000000000000004)",
+        "select v, count(*) from g group by v",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > v | count(*)",
+        "0.1 | 1",
+        "0.3 | 1",
+        "1 | 2",
+        "9007199254740992 | 1",
+        "9007199254740993 | 1",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_bare_columns_follow_min_max():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        CREATE_USERS_SQL,
+        "insert into users values (1, 'alice', 'a@corp.com'), (2, 'bob', 'b@home.org'), (11, 'carol', 'c@corp.com'), (12, 'dave', 'd@corp.com')",
+        "select max(username), id from users",
+        "select min(username), id, email from users",
+        "select substr(email, 3) as domain, max(id), username from users group by domain",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > max(username) | id",
+        "dave | 12",
+        "Executed",
+        "db > min(username) | id | email",
+        "alice | 1 | a@corp.com",
+        "Executed",
+        "db > domain | max(id) | username",
+        "corp.com | 12 | dave",
+        "home.org | 2 | bob",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_create_table():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table events (ts integer, kind varchar(8), note text)",
+        "insert into events values (-5, 'login', 'first'), (1700000000, 'logout', '')",
+        "insert into events (kind) values ('too long kind')",
+        "insert into users values (1, 'a', 'a@example.com')",
+        ".exit",
+    ]
+    results = run_script(commands)
+    results += run_script(["select kind, ts from events where ts < 0", ".exit"])
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Syntax error at column 13: no such table: users",
+        "  insert into users values (1, 'a', 'a@example.com')",
+        "              ^",
+        "db > ",
+        "db > kind | ts",
+        "login | -5",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_rejected_statement_creates_no_table():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    results = run_script(["select * from users", "update 1 set username=x", "delete from users", "insert 1 a", ".exit"])
+    results += run_script([".tables", "insert 1 user1 person1@example.com", ".tables", ".exit"])
+    expected = [
+        "db > Syntax error at column 15: no such table: users",
+        "  select * from users",
+        "                ^",
+        "db > Syntax error at column 8: no such table: users",
+        "  update 1 set username=x",
+        "         ^",
+        "db > Syntax error at column 13: no such table: users",
+        "  delete from users",
+        "              ^",
+        "db > Syntax error at column 11: expected insert <id> <username> <email>",
+        "  insert 1 a",
+        "            ^",
+        "db > ",
+        "db > db > Executed",
+        "db > users",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_schema_catalog():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table events (ts integer, kind varchar(8))",
+        "delete from sqlite_schema",
+        ".exit",
+    ]
+    results = run_script(commands)
+    results += run_script(["select type, name, rootpage, sql from sqlite_schema", ".exit"])
+    expected = [
+        "db > Executed",
+        "db > Syntax error at column 13: table sqlite_schema may not be modified",
+        "  delete from sqlite_schema",
+        "              ^",
+        "db > ",
+        "db > type | name | rootpage | sql",
+        "table | events | 2 | create table events (ts integer, kind varchar(8))",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_multiple_tables():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table orgs (id integer primary key, name varchar(32))",
+        "create table events (org integer, kind varchar(16))",
+        "insert into orgs values (1, 'acme'), (2, 'globex')",
+        "insert into events values (2, 'signup'), (1, 'login'), (2, 'login')",
+        ".exit",
+    ]
+    results = run_script(commands)
+    results += run_script([
+        ".tables",
+        "select * from orgs",
+        "select org, count(*) from events group by org",
+        ".exit",
+    ])
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > ",
+        "db > orgs",
+        "events",
+        "db > (1 acme)",
+        "(2 globex)",
+        "Executed",
+        "db > org | count(*)",
+        "1 | 1",
+        "2 | 2",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_drop_and_alter_table():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table items (id integer primary key, name varchar(16) default 'none')",
+        "insert into items values (1, 'pen')",
+        "insert into items (id) values (2)",
+        "alter table items add column qty integer default 3",
+        "alter table items rename column name to label",
+        "alter table items rename to stock",
+        "create table scratch (x integer)",
+        "drop table scratch",
+        "drop table scratch",
+        "drop table if exists scratch",
+        ".exit",
+    ]
+    results = run_script(commands)
+    results += run_script([
+        ".tables",
+        "select id, label, qty from stock",
+        "select sql from sqlite_schema",
+        ".exit",
+    ])
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Syntax error at column 12: no such table: scratch",
+        "  drop table scratch",
+        "             ^",
+        "db > Executed",
+        "db > ",
+        "db > stock",
+        "db > id | label | qty",
+        "1 | pen | 3",
+        "2 | none | 3",
+        "Executed",
+        "db > sql",
+        "CREATE TABLE stock (id integer PRIMARY KEY, label varchar(16) DEFAULT 'none', qty integer DEFAULT 3)",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_typed_values():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table readings (id integer primary key, temp real, label text, raw blob, note varchar(8))",
+        "insert into readings values (-3, 21, 42, x'00ff', null)",
+        "insert into readings (id, temp, label) values (-1, '19.5', 'ab' || x'00')",
+        "insert into readings (id, temp) values (2, 'warm')",
+        ".exit",
+    ]
+    results = run_script(commands)
+    results += run_script([
+        "select id, typeof(temp), temp, typeof(label), length(label), typeof(raw), hex(raw), note from readings",
+        "select id from readings where label = 42",
+        ".exit",
+    ])
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > ",
+        "db > id | typeof(temp) | temp | typeof(label) | length(label) | typeof(raw) | hex(raw) | note",
+        "-3 | real | 21.0 | text | 2 | blob | 00FF | NULL",
+        "-1 | real | 19.5 | text | 3 | null |  | NULL",
+        "2 | text | warm | null | NULL | null |  | NULL",
+        "Executed",
+        "db > id",
+        "-3",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_integer_overflow():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "select 9223372036854775807 + 1, -9223372036854775807 - 2, 4611686018427387904 * 2, -(-9223372036854775807 - 1), 2 * 3",
+        "select abs(-9223372036854775807 - 1)",
+        "create table t (a integer)",
+        "insert into t values (1), (9223372036854775807), (2)",
+        "select sum(a) from t",
+        "select avg(a) from t",
+        # The first row is updated before the overflow and rolled back.
+        "update t set a = 0 where abs(a * -1 - 1) > 0",
+        "select * from t",
+        ".exit",
+    ]
+    results = run_script(commands)
+    expected = [
+        "db > 9223372036854775807 + 1 | -9223372036854775807 - 2 | 4611686018427387904 * 2 | -(-9223372036854775807 - 1) | 2 * 3",
+        "9.22337203685478e+18 | -9.22337203685478e+18 | 9.22337203685478e+18 | 9.22337203685478e+18 | 6",
+        "Executed",
+        "db > abs(-9223372036854775807 - 1)",
+        "Error: integer overflow",
+        "db > Executed",
+        "db > Executed",
+        "db > sum(a)",
+        "Error: integer overflow",
+        "db > avg(a)",
+        "3.07445734561826e+18",
+        "Executed",
+        "db > Error: integer overflow",
+        "db > (1)",
+        "(9223372036854775807)",
+        "(2)",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+def test_overflow_pages():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = [
+        "create table docs (id integer primary key, body text, note text)",
+        f"insert into docs values (1, '{'a' * 10000}', 'first')",
+        f"insert into docs values (2, '{'b' * 30000}', 'second')",
+        "alter table docs add column pages integer default 0",
+        ".exit",
+    ]
+    results = run_script(commands)
+    results += run_script([
+        "select id, length(body), note, pages from docs",
+        f"select id from docs where body = '{'b' * 30000}'",
+        "update docs set body = 'short' where id = 2",
+        "select id, length(body), note from docs where id = 2",
+        ".exit",
+    ])
+    expected = [
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > Executed",
+        "db > ",
+        "db > id | length(body) | note | pages",
+        "1 | 10000 | first | 0",
+        "2 | 30000 | second | 0",
+        "Executed",
+        "db > id",
+        "2",
+        "Executed",
+        "db > 1 rows updated",
+        "Executed",
+        "db > id | length(body) | note",
+        "2 | 5 | second",
+        "Executed",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+
+    # The overflow pages freed by the update, the delete and the drop are
+    # used again.
+    size_before = os.path.getsize("something.db")
+    run_script([
+        "delete from docs where id = 1",
+        f"insert into docs values (3, '{'c' * 20000}', 'third')",
+        "drop table docs",
+        "create table more (body text)",
+        f"insert into more values ('{'d' * 40000}')",
+        ".exit",
+    ])
+    assert os.path.getsize("something.db") == size_before
+
+def test_file_header():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    run_script(["create table events (kind text)", "drop table events", "create table events (kind text)", ".exit"])
+    results = run_script([".dbinfo", ".exit"])
+    expected = [
+        "db > format version: 1",
+        "page size: 4096",
+        "page count: 3",
+        "free list head: 0",
+        "schema cookie: 3",
+        "free pages: 0",
+        "journal mode: delete",
+        "db > ",
+    ]
+    assert results == expected, f"Expected: {expected}, but got: {results}"
+    with open("something.db", "rb") as f:
+        assert f.read(16) == b"GoDB file format"
+
+    def open_db(content):
+        with open("something.db", "wb") as f:
+            f.write(content)
+        proc = subprocess.run(
+            ["go", "run", *sorted(glob.glob("p6/*.go")), "-db", "something.db"],
+            input="insert 1 a b\n.exit", capture_output=True, text=True,
+        )
+        with open("something.db", "rb") as f:
+            assert f.read() == content, "a file that was refused was changed"
+        # go run adds its own line about the exit status.
+        return proc.returncode, proc.stderr.splitlines()[0]
+
+    with open("something.db", "rb") as f:
+        database = f.read()
+    assert open_db(b"name,email\nalice,alice@example.com\n") == (1, "Error: file is not a database")
+    newer = database[:16] + (2).to_bytes(4, "little") + database[20:]
+    assert open_db(newer) == (1, "Error: file has format version 2, only version 1 is supported")
+    assert open_db(database[:8192]) == (1, "Error: file is corrupt: header says 3 pages of 4096 bytes but the file has 8192 bytes")
+
+def test_page_size():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = ["create table notes (id integer primary key, body text)"]
+    commands += [f"insert into notes values ({i}, '{'n' * 100}')" for i in range(1, 41)]
+    commands += [".exit"]
+    run_script(commands, args=["-page-size", "512"])
+    # The page size of the file wins over the flag.
+    results = run_script([".dbinfo", "select count(*), sum(length(body)) from notes", ".btree notes", ".exit"], args=["-page-size", "8192"])
+    assert results[:2] == ["db > format version: 1", "page size: 512"], results
+    assert results[7:10] == ["db > count(*) | sum(length(body))", "40 | 4000", "Executed"], results
+    # Three of these rows fit in a 512 byte leaf.
+    assert results[10:14] == ["db > Tree:", "- internal (size 12)", "  - leaf (size 3)", "    - 1"], results
+    assert os.path.getsize("something.db") % 512 == 0
+
+    proc = subprocess.run(
+        ["go", "run", *sorted(glob.glob("p6/*.go")), "-db", "something.db", "-page-size", "1000"],
+        input=".exit", capture_output=True, text=True,
+    )
+    assert proc.returncode == 1
+    assert proc.stderr.splitlines()[0] == "Error: page size 1000 is not a power of two from 512 to 65536"
+
+def test_only_dirty_pages_are_written():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands, _ = run_insert(300)
+    commands.append(".exit")
+    run_script(commands)
+
+    # Reading leaves the file alone, not even the header is written.
+    os.utime("something.db", ns=(0, 0))
+    run_script(["select", "select count(*) from users", ".btree", ".exit"], args=["-cache-size", "3"])
+    assert os.stat("something.db").st_mtime_ns == 0
+
+    results = run_script(["update users set username = 'changed' where id = 150", ".exit"], args=["-debug"])
+    written = [line for line in results if "pager_flush: Wrote page" in line]
+    assert len(written) == 1, written
+
+def test_free_list():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    def dbinfo():
+        results = run_script([".dbinfo", ".exit"])
+        return {line.removeprefix("db > ").split(": ")[0]: int(line.split(": ")[1]) for line in results if ": " in line and line.split(": ")[1].isdigit()}
+
+    create = ["create table notes (id integer primary key, body text)"]
+    create += [f"insert into notes values ({i}, '{'n' * 100}')" for i in range(1, 601)]
+    run_script(create + [".exit"], args=["-page-size", "512"])
+    info = dbinfo()
+    assert (info["free list head"], info["free pages"]) == (0, 0), info
+    page_count = info["page count"]
+
+    # Deleting most rows merges leaves and puts the pages they leave behind
+    # on the free list.
+    results = run_script(["delete from notes where id % 10 != 0", "select count(*), sum(id) from notes", ".exit"])
+    assert results[:4] == ["db > 540 rows deleted", "Executed", "db > count(*) | sum(id)", "60 | 18300"], results
+    info = dbinfo()
+    assert info["page count"] == page_count and info["free list head"] != 0, info
+    freed_by_delete = info["free pages"]
+    assert freed_by_delete > 100, info
+
+    # More pages than one 512 byte trunk page holds.
+    run_script(["drop table notes", ".exit"])
+    info = dbinfo()
+    assert info["page count"] == page_count and info["free pages"] > max(freed_by_delete, 125), info
+
+    # Building the table again takes every page from the free list.
+    run_script(create + [".exit"])
+    info = dbinfo()
+    assert (info["page count"], info["free list head"], info["free pages"]) == (page_count, 0, 0), info
+    assert os.path.getsize("something.db") == page_count * 512
+    results = run_script(["select count(*) from notes", ".exit"])
+    assert results[:2] == ["db > count(*)", "600"], results
+
+def test_vacuum():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+
+    commands = ["create table notes (id integer primary key, body text)", "create table tags (name text)"]
+    commands += [f"insert into notes values ({i}, '{'n' * (100 if i % 50 else 3000)}')" for i in range(1, 601)]
+    commands += ["insert into tags values ('first')", "delete from notes where id % 10 != 0", ".exit"]
+    run_script(commands, args=["-page-size", "512"])
+    size_before = os.path.getsize("something.db")
+
+    results = run_script(["vacuum", ".dbinfo", ".exit"])
+    reclaimed = int(results[0].removeprefix("db > ").removesuffix(" bytes reclaimed"))
+    assert results[1] == "Executed", results
+    assert "free pages: 0" in results, results
+    assert reclaimed > size_before // 2
+    assert os.path.getsize("something.db") == size_before - reclaimed
+    assert not os.path.exists("something.db-vacuum")
+
+    # The rows, the overflow pages and the order of the tables survive, the
+    # leaves are packed full.
+    results = run_script([
+        "select count(*), sum(id), sum(length(body)) from notes",
+        "select * from tags",
+        ".tables",
+        ".btree notes",
+        ".exit",
+    ])
+    assert results[:5] == ["db > count(*) | sum(id) | sum(length(body))", "60 | 18300 | 40800", "Executed", "db > (first)", "Executed"], results
+    assert results[5:7] == ["db > notes", "tags"], results
+    assert results[8:10] == ["- internal (size 14)", "  - leaf (size 4)"], results
+
+    # Nothing left to reclaim.
+    results = run_script([".vacuum", ".exit"])
+    assert results[0] == "db > 0 bytes reclaimed", results
+
+def build_binary(directory):
+    # go run would only kill itself when killed, not the database.
+    binary = os.path.join(directory, "db")
+    subprocess.run(["go", "build", "-o", binary, *sorted(glob.glob("p6/*.go"))], check=True)
+    return binary
+
+def test_rollback_journal():
+    if os.path.exists("something.db"):
+        os.remove("something.db")
+    build_dir = tempfile.TemporaryDirectory()
+    binary = build_binary(build_dir.name)
+
+    # Every statement is committed on its own, so a crash loses nothing
+    # that already said Executed.
+    proc = subprocess.Popen([binary, "-db", "something.db", "-page-size", "512"], stdin=subprocess.PIPE, stdout=subprocess.PIPE, text=True)
+    commands = ["create table notes (id integer primary key, body text)"]
+    commands += ["insert into notes values " + ", ".join(f"({i}, '{'n' * 100}')" for i in range(1, 3001))]
+    commands += [f"insert into notes values ({i}, '{'n' * 100}')" for i in range(3001, 3011)]
+    proc.stdin.write("\n".join(commands) + "\n")
+    proc.stdin.flush()
+    for _ in commands:
+        assert proc.stdout.readline().endswith("Executed\n")
+    proc.kill()
+    proc.wait()
+    assert not os.path.exists("something.db-journal")
+    results = run_script(["select count(*), sum(id) from notes", ".exit"])
+    assert results[:2] == ["db > count(*) | sum(id)", "3010 | 4531555"], results
+
+    # Kill it in the middle of an update that does not fit in the cache, so
+    # part of it is already in the file.
+    with open("something.db", "rb") as f:
+        before = f.read()
+    proc = subprocess.Popen([binary, "-db", "something.db", "-cache-size", "2"], stdin=subprocess.PIPE, stdout=subprocess.DEVNULL, text=True)
+    proc.stdin.write(f"update notes set body = '{'u' * 150}'\n")
+    proc.stdin.flush()
+    while True:
+        with open("something.db", "rb") as f:
+            if f.read() != before:
+                break
+    proc.kill()
+    proc.wait()
+    assert os.path.exists("something.db-journal")
+
+    # Opening the file puts back what the journal saved.
+    results = run_script(["select count(*), sum(length(body)) from notes", ".exit"])
+    assert results[:2] == ["db > count(*) | sum(length(body))", "3010 | 301000"], results
+    assert not os.path.exists("something.db-journal")
+    with open("something.db", "rb") as f:
+        assert f.read() == before
+
+def test_wal_mode():
+    for name in ["something.db", "something.db-wal"]:
+        if os.path.exists(name):
+            os.remove(name)
+    build_dir = tempfile.TemporaryDirectory()
+    binary = build_binary(build_dir.name)
+
+    results = run_script([
+        "create table notes (id integer primary key, body text)",
+        "pragma journal_mode",
+        "PRAGMA journal_mode = WAL",
+        ".exit",
+    ])
+    assert results == ["db > Executed", "db > journal_mode", "delete", "Executed", "db > journal_mode", "wal", "Executed", "db > "], results
+    # Closing the database checkpoints the log and deletes it.
+    assert not os.path.exists("something.db-wal")
+    with open("something.db", "rb") as f:
+        before = f.read()
+
+    # Commits only append to the log, so a crash leaves the database file
+    # as it was and the rows in the log.
+    proc = subprocess.Popen([binary, "-db", "something.db"], stdin=subprocess.PIPE, stdout=subprocess.PIPE, text=True)
+    commands = [f"insert into notes values ({i}, '{'n' * 100}')" for i in range(1, 101)]
+    commands.append("update notes set body = 'changed' where id = 50")
+    proc.stdin.write("\n".join(commands) + "\n")
+    proc.stdin.flush()
+    for _ in commands:
+        while not proc.stdout.readline().endswith("Executed\n"):
+            pass
+    proc.kill()
+    proc.wait()
+    with open("something.db", "rb") as f:
+        assert f.read() == before
+    assert os.path.getsize("something.db-wal") > 100 * 4096
+
+    results = run_script(["select count(*), sum(id) from notes", "select body from notes where id = 50", ".checkpoint", ".exit"])
+    assert results[:5] == ["db > count(*) | sum(id)", "100 | 5050", "Executed", "db > body", "changed"], results
+    # The header and the six pages the table has now.
+    assert results[6] == "db > 7 pages checkpointed", results
+    assert not os.path.exists("something.db-wal")
+
+    results = run_script([".dbinfo", "pragma journal_mode = delete", ".checkpoint", "select count(*) from notes", ".exit"])
+    assert "journal mode: wal" in results, results
+    assert results[-8:-1] == ["db > journal_mode", "delete", "Executed", "db > Error: database is not in WAL mode", "db > count(*)", "100", "Executed"], results
+
+    results = run_script(["pragma page_size", "pragma journal_mode = memory", ".exit"])
+    assert results == [
+        "db > Syntax error at column 8: unknown pragma: page_size",
+        "  pragma page_size",
+        "         ^",
+        "db > Syntax error at column 23: journal_mode must be one of delete, wal",
+        "  pragma journal_mode = memory",
+        "                        ^",
+        "db > ",
+    ], results
+
+
+def test_transactions():
+    for mode in ["delete", "wal"]:
+        for name in ["something.db", "something.db-journal", "something.db-wal"]:
+            if os.path.exists(name):
+                os.remove(name)
+        results = run_script([
+            f"pragma journal_mode = {mode}",
+            "create table t (id integer primary key, body text)",
+            # A statement that fails lands none of its rows.
+            "insert into t values (1, 'a'), (2, 'b'), (1, 'c')",
+            "select count(*) from t",
+            ".exit",
+        ])
+        assert results[4:] == ["db > Error: Duplicate key", "db > count(*)", "0", "Executed", "db > "], results
+
+        # The pages of a large transaction do not fit in a cache of two,
+        # rolling back has to undo the ones already written.
+        commands = ["begin"]
+        commands += [f"insert into t values ({i}, '{'x' * 500}')" for i in range(1, 301)]
+        commands += ["create table u (a integer)", "drop table t", ".tables", "rollback", ".tables", "select count(*) from t"]
+        results = run_script(commands + [".exit"], args=["-cache-size", "2"])
+        assert results[-9:] == ["db > Executed", "db > Executed", "db > u", "db > Executed", "db > t", "db > count(*)", "0", "Executed", "db > "], results[-9:]
+
+        # Inside a transaction a failed statement is undone on its own.
+        results = run_script([
+            "BEGIN TRANSACTION",
+            "insert into t values (1, 'one')",
+            "insert into t values (2, 'two'), (1, 'again')",
+            "insert into t values (3, 'three')",
+            "COMMIT",
+            "begin",
+            "insert into t values (4, 'four')",
+            ".exit",
+        ])
+        assert results == ["db > Executed", "db > Executed", "db > Error: Duplicate key", "db > Executed", "db > Executed", "db > Executed", "db > Executed", "db > "], results
+        # A transaction still open on exit is rolled back.
+        results = run_script(["select * from t", ".exit"])
+        assert results == ["db > (1 one)", "(3 three)", "Executed", "db > "], results
+
+        # The pages a failed statement changed come back from the statement
+        # journal, most of them were evicted from the cache of two.
+        rows = ", ".join(f"({i}, '{'y' * 500}')" for i in range(10, 310))
+        results = run_script([
+            "begin",
+            "update t set body = 'changed'",
+            f"insert into t values {rows}, (1, 'again')",
+            "commit",
+            "select * from t",
+            ".exit",
+        ], args=["-cache-size", "2"])
+        assert results[3:] == ["db > Error: Duplicate key", "db > Executed", "db > (1 changed)", "(3 changed)", "Executed", "db > "], results
+
+    results = run_script([
+        "commit",
+        "rollback",
+        "begin",
+        "begin",
+        "vacuum",
+        "pragma journal_mode = delete",
+        ".checkpoint",
+        "rollback",
+        ".exit",
+    ])
+    assert results == [
+        "db > Error: cannot commit - no transaction is active",
+        "db > Error: cannot rollback - no transaction is active",
+        "db > Executed",
+        "db > Error: cannot start a transaction within a transaction",
+        "db > Error: cannot VACUUM from within a transaction",
+        "db > Error: cannot change the journal mode from within a transaction",
+        "db > Error: cannot checkpoint from within a transaction",
+        "db > Executed",
+        "db > ",
+    ], results
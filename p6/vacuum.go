@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// vacuum_database rebuilds the database into a new file, with every table
+// packed into as few pages as it takes and no free pages, and puts it in
+// place of the old one. It returns how many bytes smaller the file got.
+// Pages the old file has in memory are read but never written, so on an
+// error the old file is left as it was.
+func vacuum_database(db *Database) (int64, error) {
+	pager := db.pager
+	filename := pager.file_descriptor.Name()
+	vacuumFilename := filename + "-vacuum"
+	oldSize := int64(pager.num_pages) * int64(pager.page_size)
+	// A log left next to the new file would be read as its own, so it is
+	// copied into the old file and deleted first. The new file starts out
+	// with a rollback journal and is switched to WAL mode once in place.
+	journalMode := pager.header.journal_mode
+	wal_close(pager)
+
+	if err := os.Remove(vacuumFilename); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("could not remove %s: %v", vacuumFilename, err)
+	}
+	vacuumDb, err := db_open(vacuumFilename, pager.page_size, pager.cache_size)
+	if err != nil {
+		return 0, err
+	}
+	// The catalog entries keep their keys, so the tables stay in the order
+	// they were created.
+	for cursor := table_start(db.catalog); !cursor.end_of_table; cursor_advance(cursor) {
+		pager_release(pager)
+		key := cursor_key(cursor)
+		entry := cursor_row(cursor)
+		table := find_table(db, entry[CATALOG_NAME].text)
+		if entry[CATALOG_TYPE].text == "table" && table != nil {
+			rootPageNum := build_tree(vacuumDb.pager, table_start(table))
+			entry[CATALOG_ROOT_PAGE] = integer_value(int64(rootPageNum))
+			log.Printf("INFO: vacuum_database: Copied table %s to root page %d\n", table.schema.name, rootPageNum)
+		}
+		table_insert(vacuumDb.catalog, key, entry)
+	}
+	vacuumDb.pager.header.schema_cookie = pager.header.schema_cookie + 1
+	newSize := int64(vacuumDb.pager.num_pages) * int64(vacuumDb.pager.page_size)
+	db_close(vacuumDb)
+
+	// The new file has to be on disk before it replaces the old one.
+	if err := sync_file(vacuumFilename); err != nil {
+		os.Remove(vacuumFilename)
+		return 0, err
+	}
+	if err := os.Rename(vacuumFilename, filename); err != nil {
+		os.Remove(vacuumFilename)
+		return 0, fmt.Errorf("could not replace %s: %v", filename, err)
+	}
+	if err := sync_file(filepath.Dir(filename)); err != nil {
+		log.Printf("WARNING: vacuum_database: Rename of %s may not be on disk: %v\n", filename, err)
+	}
+	pager.file_descriptor.Close()
+	reopened, err := db_open(filename, pager.page_size, pager.cache_size)
+	if err != nil {
+		log.Fatalf("ERROR: vacuum_database: Could not open the rebuilt file %s: %v\n", filename, err)
+	}
+	*db = *reopened
+	if journalMode == JOURNAL_MODE_WAL {
+		set_journal_mode(db.pager, journalMode)
+		pager_commit(db.pager)
+	}
+	log.Printf("INFO: vacuum_database: Rebuilt %s from %d to %d bytes\n", filename, oldSize, newSize)
+	return oldSize - newSize, nil
+}
+
+// sync_file flushes a closed file, or a directory, to disk.
+func sync_file(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", filename, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+)
+
+/*
+ * Write-Ahead Log Layout. In WAL mode the database file is not written when
+ * a transaction commits, the pages it changed are appended to <db>-wal as
+ * frames instead and the last frame of the transaction records the page
+ * count after it. Reads look a page up in the WAL index, the latest
+ * committed frame of every page in the log, before going to the database
+ * file. A checkpoint copies those frames into the database file and starts
+ * the log over.
+ *
+ * The checksum of a frame covers the frame and the checksum of the one
+ * before it, starting from the header, whose salt changes every time the
+ * log starts over. A frame left over from before, or cut short by a crash,
+ * ends the log.
+ */
+const (
+	WAL_SUFFIX           = "-wal"
+	WAL_MAGIC            = "GoDB wal"
+	WAL_MAGIC_SIZE       = 8
+	WAL_PAGE_SIZE_OFFSET = WAL_MAGIC_SIZE
+	WAL_SALT_OFFSET      = WAL_PAGE_SIZE_OFFSET + 4
+	WAL_CHECKSUM_OFFSET  = WAL_SALT_OFFSET + 4
+	WAL_HEADER_SIZE      = WAL_CHECKSUM_OFFSET + 4
+)
+
+/*
+ * WAL Frame Header Layout. The page count is 0 except in the frame that
+ * commits a transaction.
+ */
+const (
+	WAL_FRAME_PAGE_NUM_OFFSET   = 0
+	WAL_FRAME_PAGE_COUNT_OFFSET = WAL_FRAME_PAGE_NUM_OFFSET + 4
+	WAL_FRAME_CHECKSUM_OFFSET   = WAL_FRAME_PAGE_COUNT_OFFSET + 4
+	WAL_FRAME_HEADER_SIZE       = WAL_FRAME_CHECKSUM_OFFSET + 4
+)
+
+// WAL_AUTOCHECKPOINT is how many frames the log may hold after a commit
+// before it is checkpointed.
+const WAL_AUTOCHECKPOINT = 1000
+
+func wal_frame_size(pageSize uint32) int64 {
+	return WAL_FRAME_HEADER_SIZE + int64(pageSize)
+}
+
+func wal_frame_checksum(previous uint32, frame []byte) uint32 {
+	checksum := crc32.Update(previous, crc32.IEEETable, frame[:WAL_FRAME_CHECKSUM_OFFSET])
+	return crc32.Update(checksum, crc32.IEEETable, frame[WAL_FRAME_HEADER_SIZE:])
+}
+
+// wal_open reads the log of the database file, if it has one, and indexes
+// the frames of every transaction that was committed. It returns the page
+// count of the last one, or 0 and deletes the log if it holds none.
+func wal_open(pager *Pager) (uint32, error) {
+	filename := pager.file_descriptor.Name() + WAL_SUFFIX
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not open write-ahead log %s: %v", filename, err)
+	}
+
+	header := make([]byte, WAL_HEADER_SIZE)
+	if _, err := io.ReadFull(f, header); err != nil ||
+		string(header[:WAL_MAGIC_SIZE]) != WAL_MAGIC ||
+		binary.LittleEndian.Uint32(header[WAL_CHECKSUM_OFFSET:]) != crc32.ChecksumIEEE(header[:WAL_CHECKSUM_OFFSET]) ||
+		!is_valid_page_size(binary.LittleEndian.Uint32(header[WAL_PAGE_SIZE_OFFSET:])) {
+		// Nothing was committed to a log without a complete header.
+		f.Close()
+		log.Printf("WARNING: wal_open: Write-ahead log %s has no valid header, ignoring it\n", filename)
+		return 0, os.Remove(filename)
+	}
+	pageSize := binary.LittleEndian.Uint32(header[WAL_PAGE_SIZE_OFFSET:])
+	pager.wal_file = f
+	pager.wal_index = make(map[uint32]int64)
+	pager.wal_pending = make(map[uint32]int64)
+	pager.wal_length = WAL_HEADER_SIZE
+	pager.wal_checksum = binary.LittleEndian.Uint32(header[WAL_CHECKSUM_OFFSET:])
+
+	var pageCount uint32
+	frame := make([]byte, wal_frame_size(pageSize))
+	offset := int64(WAL_HEADER_SIZE)
+	checksum := pager.wal_checksum
+	uncommitted := make(map[uint32]int64)
+	for {
+		if _, err := f.ReadAt(frame, offset); err != nil {
+			break
+		}
+		checksum = wal_frame_checksum(checksum, frame)
+		if binary.LittleEndian.Uint32(frame[WAL_FRAME_CHECKSUM_OFFSET:]) != checksum {
+			break
+		}
+		uncommitted[binary.LittleEndian.Uint32(frame[WAL_FRAME_PAGE_NUM_OFFSET:])] = offset
+		offset += int64(len(frame))
+		if commit := binary.LittleEndian.Uint32(frame[WAL_FRAME_PAGE_COUNT_OFFSET:]); commit != 0 {
+			for pageNum, frameOffset := range uncommitted {
+				pager.wal_index[pageNum] = frameOffset
+			}
+			clear(uncommitted)
+			pageCount = commit
+			pager.wal_length = offset
+			pager.wal_checksum = checksum
+		}
+	}
+	if pageCount == 0 {
+		pager.wal_file = nil
+		f.Close()
+		return 0, os.Remove(filename)
+	}
+	pager.wal_committed_length = pager.wal_length
+	pager.wal_committed_checksum = pager.wal_checksum
+	pager.page_size = pageSize
+	log.Printf("INFO: wal_open: Write-ahead log %s has %d committed pages\n", filename, len(pager.wal_index))
+	return pageCount, nil
+}
+
+// wal_reset starts the log over with a new salt, creating it if needed.
+func wal_reset(pager *Pager) {
+	if pager.wal_file == nil {
+		filename := pager.file_descriptor.Name() + WAL_SUFFIX
+		f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("ERROR: wal_reset: Could not create write-ahead log %s: %v\n", filename, err)
+		}
+		pager.wal_file = f
+	}
+	header := make([]byte, WAL_HEADER_SIZE)
+	copy(header, WAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[WAL_PAGE_SIZE_OFFSET:], pager.page_size)
+	binary.LittleEndian.PutUint32(header[WAL_SALT_OFFSET:], rand.Uint32())
+	binary.LittleEndian.PutUint32(header[WAL_CHECKSUM_OFFSET:], crc32.ChecksumIEEE(header[:WAL_CHECKSUM_OFFSET]))
+	if err := pager.wal_file.Truncate(0); err != nil {
+		log.Fatalf("ERROR: wal_reset: Could not truncate write-ahead log: %v\n", err)
+	}
+	if _, err := pager.wal_file.WriteAt(header, 0); err != nil {
+		log.Fatalf("ERROR: wal_reset: Could not write write-ahead log: %v\n", err)
+	}
+	pager.wal_index = make(map[uint32]int64)
+	pager.wal_pending = make(map[uint32]int64)
+	pager.wal_length = WAL_HEADER_SIZE
+	pager.wal_committed_length = WAL_HEADER_SIZE
+	pager.wal_checksum = binary.LittleEndian.Uint32(header[WAL_CHECKSUM_OFFSET:])
+	pager.wal_committed_checksum = pager.wal_checksum
+}
+
+// wal_find_frame returns where the latest frame of a page is, looking at
+// the current transaction first.
+func wal_find_frame(pager *Pager, pageNum uint32) (int64, bool) {
+	if offset, ok := pager.wal_pending[pageNum]; ok {
+		return offset, true
+	}
+	offset, ok := pager.wal_index[pageNum]
+	return offset, ok
+}
+
+// wal_append adds a frame for a page to the log. pageCount is 0 unless the
+// frame commits the transaction.
+func wal_append(pager *Pager, page *Page, pageCount uint32) {
+	if pager.wal_file == nil {
+		wal_reset(pager)
+	}
+	frame := make([]byte, wal_frame_size(pager.page_size))
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_PAGE_NUM_OFFSET:], page.page_num)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_PAGE_COUNT_OFFSET:], pageCount)
+	copy(frame[WAL_FRAME_HEADER_SIZE:], page.data)
+	pager.wal_checksum = wal_frame_checksum(pager.wal_checksum, frame)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_CHECKSUM_OFFSET:], pager.wal_checksum)
+	if _, err := pager.wal_file.WriteAt(frame, pager.wal_length); err != nil {
+		log.Fatalf("ERROR: wal_append: Could not write page %d to the write-ahead log: %v\n", page.page_num, err)
+	}
+	pager.wal_pending[page.page_num] = pager.wal_length
+	pager.wal_length += int64(len(frame))
+	log.Printf("INFO: wal_append: Wrote page %d to the write-ahead log\n", page.page_num)
+}
+
+// wal_commit appends the pages changed since the last commit to the log,
+// the last one marked as the commit, and syncs it.
+func wal_commit(pager *Pager) {
+	var dirty []*Page
+	for element := pager.lru.Front(); element != nil; element = element.Next() {
+		if page := element.Value.(*Page); page.dirty {
+			dirty = append(dirty, page)
+		}
+	}
+	if len(dirty) == 0 {
+		if len(pager.wal_pending) == 0 {
+			return
+		}
+		// Every change has been written to the log already, one more
+		// frame is needed to commit them.
+		dirty = append(dirty, get_page(pager, HEADER_PAGE_NUM))
+	}
+	slices.SortFunc(dirty, func(a, b *Page) int { return int(a.page_num) - int(b.page_num) })
+	for i, page := range dirty {
+		pageCount := uint32(0)
+		if i == len(dirty)-1 {
+			pageCount = pager.num_pages
+		}
+		wal_append(pager, page, pageCount)
+		page.dirty = false
+	}
+	if err := pager.wal_file.Sync(); err != nil {
+		log.Fatalf("ERROR: wal_commit: Could not sync the write-ahead log: %v\n", err)
+	}
+	for pageNum, offset := range pager.wal_pending {
+		pager.wal_index[pageNum] = offset
+	}
+	clear(pager.wal_pending)
+	pager.wal_committed_length = pager.wal_length
+	pager.wal_committed_checksum = pager.wal_checksum
+
+	if (pager.wal_length-WAL_HEADER_SIZE)/wal_frame_size(pager.page_size) >= WAL_AUTOCHECKPOINT {
+		wal_checkpoint(pager)
+	}
+}
+
+// wal_checkpoint copies the latest committed frame of every page in the log
+// to the database file and starts the log over. It returns the number of
+// pages copied. The log stays as it is until the database file is synced,
+// so a crash in between only means doing it again.
+func wal_checkpoint(pager *Pager) int {
+	if pager.wal_file == nil {
+		return 0
+	}
+	pageNums := make([]uint32, 0, len(pager.wal_index))
+	for pageNum := range pager.wal_index {
+		pageNums = append(pageNums, pageNum)
+	}
+	slices.Sort(pageNums)
+	data := make([]byte, pager.page_size)
+	for _, pageNum := range pageNums {
+		if _, err := pager.wal_file.ReadAt(data, pager.wal_index[pageNum]+WAL_FRAME_HEADER_SIZE); err != nil {
+			log.Fatalf("ERROR: wal_checkpoint: Could not read page %d from the write-ahead log: %v\n", pageNum, err)
+		}
+		if _, err := pager.file_descriptor.WriteAt(data, int64(pageNum)*int64(pager.page_size)); err != nil {
+			log.Fatalf("ERROR: wal_checkpoint: Could not write page %d: %v\n", pageNum, err)
+		}
+	}
+	fileLength := int64(pager.header.page_count) * int64(pager.page_size)
+	if err := pager.file_descriptor.Truncate(fileLength); err != nil {
+		log.Fatalf("ERROR: wal_checkpoint: Could not resize database file: %v\n", err)
+	}
+	pager.file_length = fileLength
+	if err := pager.file_descriptor.Sync(); err != nil {
+		log.Fatalf("ERROR: wal_checkpoint: Could not sync database file: %v\n", err)
+	}
+	wal_reset(pager)
+	if err := pager.wal_file.Sync(); err != nil {
+		log.Fatalf("ERROR: wal_checkpoint: Could not sync the write-ahead log: %v\n", err)
+	}
+	log.Printf("INFO: wal_checkpoint: Copied %d pages to the database file\n", len(pageNums))
+	return len(pageNums)
+}
+
+// wal_close checkpoints the log and deletes it.
+func wal_close(pager *Pager) {
+	if pager.wal_file == nil {
+		return
+	}
+	wal_checkpoint(pager)
+	filename := pager.wal_file.Name()
+	pager.wal_file.Close()
+	if err := os.Remove(filename); err != nil {
+		log.Fatalf("ERROR: wal_close: Could not delete write-ahead log %s: %v\n", filename, err)
+	}
+	pager.wal_file = nil
+	pager.wal_index = nil
+	pager.wal_pending = nil
+}
+
+// set_journal_mode switches between the rollback journal and the
+// write-ahead log, the next commit writes the header that says which.
+// Leaving WAL mode checkpoints and deletes the log first.
+func set_journal_mode(pager *Pager, mode JournalMode) {
+	if mode == pager.header.journal_mode {
+		return
+	}
+	if pager.header.journal_mode == JOURNAL_MODE_WAL {
+		wal_close(pager)
+	}
+	pager.header.journal_mode = mode
+	log.Printf("INFO: set_journal_mode: Journal mode is now %s\n", JOURNAL_MODE_NAMES[mode])
+}